@@ -0,0 +1,216 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Storage of the uploaded artifacts, selected with ARTIFACT_STORE. Artifacts are gzipped tarballs
+type ArtifactStore interface {
+	Create(runId string, name string) (io.WriteCloser, error)
+	Open(runId string, name string) (io.ReadCloser, error)
+	Delete(runId string) error
+}
+
+var artifactStore = getArtifactStore()
+
+func getArtifactStore() ArtifactStore {
+	switch os.Getenv("ARTIFACT_STORE") {
+	case "", "filesystem":
+		return &fileSystemArtifactStore{root: getEnvString("ARTIFACT_STORE_PATH", "/var/lib/agnops/artifacts")}
+	case "s3":
+		return &s3ArtifactStore{
+			endpoint:        strings.TrimRight(os.Getenv("S3_ENDPOINT"), "/"),
+			bucket:          os.Getenv("S3_BUCKET"),
+			region:          getEnvString("S3_REGION", "us-east-1"),
+			accessKeyId:     os.Getenv("S3_ACCESS_KEY_ID"),
+			secretAccessKey: os.Getenv("S3_SECRET_ACCESS_KEY"),
+		}
+	default:
+		log.Printf("Unknown ARTIFACT_STORE %s, using the filesystem\n", os.Getenv("ARTIFACT_STORE"))
+		return &fileSystemArtifactStore{root: "/var/lib/agnops/artifacts"}
+	}
+}
+
+type fileSystemArtifactStore struct {
+	root string
+}
+
+func (store *fileSystemArtifactStore) getPath(runId string, name string) string {
+	return filepath.Join(store.root, runId, name+".tar.gz")
+}
+
+func (store *fileSystemArtifactStore) Create(runId string, name string) (io.WriteCloser, error) {
+	if err := os.MkdirAll(filepath.Join(store.root, runId), 0755); err != nil {
+		return nil, err
+	}
+	return os.Create(store.getPath(runId, name))
+}
+
+func (store *fileSystemArtifactStore) Open(runId string, name string) (io.ReadCloser, error) {
+	return os.Open(store.getPath(runId, name))
+}
+
+func (store *fileSystemArtifactStore) Delete(runId string) error {
+	return os.RemoveAll(filepath.Join(store.root, runId))
+}
+
+// S3 compatible store using path style URLs, such as MinIO, signed with AWS signature version 4
+type s3ArtifactStore struct {
+	endpoint        string
+	bucket          string
+	region          string
+	accessKeyId     string
+	secretAccessKey string
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func (store *s3ArtifactStore) getKey(runId string, name string) string {
+	return runId + "/" + name + ".tar.gz"
+}
+
+func (store *s3ArtifactStore) do(method string, key string, query url.Values, body io.Reader, contentLength int64) (*http.Response, error) {
+	requestUrl, err := url.Parse(store.endpoint + "/" + store.bucket + "/" + key)
+	if err != nil {
+		return nil, err
+	}
+	requestUrl.RawQuery = query.Encode()
+
+	request, err := http.NewRequest(method, requestUrl.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	request.ContentLength = contentLength
+
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	scope := now.Format("20060102") + "/" + store.region + "/s3/aws4_request"
+	request.Header.Set("X-Amz-Date", amzDate)
+	request.Header.Set("X-Amz-Content-Sha256", "UNSIGNED-PAYLOAD")
+
+	canonicalRequest := strings.Join([]string{
+		method,
+		requestUrl.EscapedPath(),
+		requestUrl.RawQuery,
+		"host:" + requestUrl.Host + "\nx-amz-content-sha256:UNSIGNED-PAYLOAD\nx-amz-date:" + amzDate + "\n",
+		"host;x-amz-content-sha256;x-amz-date",
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+	canonicalRequestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalRequestHash[:])
+
+	signingKey := []byte("AWS4" + store.secretAccessKey)
+	for _, part := range strings.Split(scope, "/") {
+		signingKey = hmacSha256(signingKey, part)
+	}
+	signature := hex.EncodeToString(hmacSha256(signingKey, stringToSign))
+	request.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=host;x-amz-content-sha256;x-amz-date, Signature=%s", store.accessKeyId, scope, signature))
+
+	client := &http.Client{Timeout: 10 * time.Minute}
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode == http.StatusNotFound {
+		response.Body.Close()
+		return nil, os.ErrNotExist
+	}
+	if response.StatusCode >= 300 {
+		defer response.Body.Close()
+		responseBody, _ := ioutil.ReadAll(response.Body)
+		return nil, fmt.Errorf("%s %s returned %d: %s", method, key, response.StatusCode, responseBody)
+	}
+	return response, nil
+}
+
+// S3 needs the length of the object, the artifact is spooled to a temporary file and put on Close
+type s3Upload struct {
+	*os.File
+	store *s3ArtifactStore
+	key   string
+}
+
+func (upload *s3Upload) Close() error {
+	defer os.Remove(upload.Name())
+	defer upload.File.Close()
+
+	size, err := upload.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := upload.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	response, err := upload.store.do(http.MethodPut, upload.key, url.Values{}, upload.File, size)
+	if err != nil {
+		return err
+	}
+	return response.Body.Close()
+}
+
+func (store *s3ArtifactStore) Create(runId string, name string) (io.WriteCloser, error) {
+	file, err := ioutil.TempFile("", "artifact-")
+	if err != nil {
+		return nil, err
+	}
+	return &s3Upload{File: file, store: store, key: store.getKey(runId, name)}, nil
+}
+
+func (store *s3ArtifactStore) Open(runId string, name string) (io.ReadCloser, error) {
+	response, err := store.do(http.MethodGet, store.getKey(runId, name), url.Values{}, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	return response.Body, nil
+}
+
+func (store *s3ArtifactStore) Delete(runId string) error {
+	response, err := store.do(http.MethodGet, "", url.Values{"list-type": {"2"}, "prefix": {runId + "/"}}, nil, 0)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	var listing struct {
+		Contents []struct {
+			Key string
+		}
+	}
+	if err := xml.NewDecoder(response.Body).Decode(&listing); err != nil {
+		return err
+	}
+
+	var keys []string
+	for _, object := range listing.Contents {
+		keys = append(keys, object.Key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		response, err := store.do(http.MethodDelete, key, url.Values{}, nil, 0)
+		if err != nil && err != os.ErrNotExist {
+			return err
+		}
+		if err == nil {
+			response.Body.Close()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// URL of the job-generator API as seen from the job pods, which upload and download artifacts through it
+var artifactsApiUrl = strings.TrimRight(os.Getenv("ARTIFACTS_API_URL"), "/")
+var artifactHelperImage = getEnvString("ARTIFACT_HELPER_IMAGE", "busybox:1.32")
+var artifactMaxSizeMb = getEnvInt("ARTIFACT_MAX_SIZE_MB", 512)
+var artifactRetentionDays = getEnvInt("ARTIFACT_RETENTION_DAYS", 7)
+
+var artifactNameRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,99}$`)
+
+const artifactsKeySecretName = "agnops-artifacts-key"
+
+var artifactsKey []byte
+var artifactsKeyOnce sync.Once
+
+// Files of /data matching paths once the step finished, paths being globs relative to /data
+type WorkflowArtifact struct {
+	Name  string   `yaml:"name"`
+	Paths []string `yaml:"paths"`
+}
+
+// An artifact of another workflow of the same commit, extracted under path relative to /data before the steps
+type WorkflowArtifactDownload struct {
+	Workflow string `yaml:"workflow"`
+	Name     string `yaml:"name"`
+	Path     string `yaml:"path"`
+}
+
+type ArtifactRecord struct {
+	Name       string    `json:"name"`
+	Step       string    `json:"step"`
+	Size       int64     `json:"size"`
+	UploadedAt time.Time `json:"uploadedAt"`
+}
+
+// Entrypoint of the artifact-upload sidecar. Each line of AGNOPS_ARTIFACTS holds the step index, step name, artifact
+// name and comma separated paths of an artifact, uploaded once the step recorded its exit code unless it was skipped.
+// The matching files are copied by find itself, so their names are never split by the shell. The sidecar fails when
+// an artifact could not be uploaded
+const artifactUploadScript = `
+steps=` + stepsDir + `
+` + stepWaitFunctions + `
+echo "$AGNOPS_ARTIFACTS" | {
+  status=0
+  while read step step_name name patterns; do
+    [ -z "$step" ] && continue
+    wait_for $step exit
+    if [ "$(cat $steps/$step.exit)" = "skipped" ]; then
+      echo "agnops: not uploading artifact $name, step $step_name was skipped"
+      continue
+    fi
+    rm -rf /tmp/artifact && mkdir -p /tmp/artifact
+    (cd /data && set -f && for pattern in $(echo $patterns | tr , ' '); do
+      find . -path "./$pattern" \( -type f -o -type l \) -exec sh -c 'mkdir -p "/tmp/artifact/${1%/*}" && cp -a "$1" "/tmp/artifact/$1"' sh {} \;
+    done)
+    if [ -z "$(ls -A /tmp/artifact)" ]; then
+      echo "agnops: no file matches artifact $name"
+      continue
+    fi
+    if tar czf /tmp/artifact.tar.gz -C /tmp/artifact . &&
+      wget -q -O /dev/null --header "Authorization: Bearer $AGNOPS_ARTIFACTS_TOKEN" --header "Content-Type: application/gzip" --post-file /tmp/artifact.tar.gz "$AGNOPS_ARTIFACTS_URL/$name?step=$step_name"; then
+      echo "agnops: uploaded artifact $name"
+    else
+      echo "agnops: failed to upload artifact $name"
+      status=1
+    fi
+    rm -rf /tmp/artifact /tmp/artifact.tar.gz
+  done
+  exit $status
+}
+`
+
+// Entrypoint of the artifact-download init container. Each line of AGNOPS_DOWNLOADS holds the workflow, artifact
+// name and destination of an artifact uploaded by that workflow for the same commit, downloaded with the artifacts
+// token of the run
+const artifactDownloadScript = `
+echo "$AGNOPS_DOWNLOADS" | while read workflow name path; do
+  [ -z "$workflow" ] && continue
+  mkdir -p /data/$path
+  url="$AGNOPS_ARTIFACTS_API_URL/api/artifacts?run=$AGNOPS_RUN_ID&workflow=$workflow&name=$name"
+  if ! wget -q -O - --header "Authorization: Bearer $AGNOPS_ARTIFACTS_TOKEN" "$url" | tar xzf - -C /data/$path; then
+    echo "agnops: failed to download artifact $name of workflow $workflow"
+    exit 1
+  fi
+  echo "agnops: downloaded artifact $name of workflow $workflow to /data/$path"
+done || exit 1
+`
+
+func getArtifactsKey() []byte {
+	artifactsKeyOnce.Do(func() {
+		secret, err := secretsClient.Get(context.TODO(), artifactsKeySecretName, metav1.GetOptions{})
+		if err == nil {
+			artifactsKey = secret.Data["Key"]
+			return
+		}
+		if !errors.IsNotFound(err) {
+			failOnError(err, "Failed to read the artifacts key")
+			return
+		}
+
+		key, err := randomHex(32)
+		if err != nil {
+			failOnError(err, "Failed to generate the artifacts key")
+			return
+		}
+		secretSpec := apiv1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      artifactsKeySecretName,
+				Namespace: namespace,
+				Labels:    map[string]string{"AgnOps": "ArtifactsKey"},
+			},
+			Data: map[string][]byte{"Key": []byte(key)},
+			Type: "Opaque",
+		}
+		_, err = secretsClient.Create(context.TODO(), &secretSpec, metav1.CreateOptions{})
+		if errors.IsAlreadyExists(err) {
+			secret, err = secretsClient.Get(context.TODO(), artifactsKeySecretName, metav1.GetOptions{})
+			if err == nil {
+				artifactsKey = secret.Data["Key"]
+			}
+			return
+		}
+		failOnError(err, "Failed to store the artifacts key")
+		if err == nil {
+			artifactsKey = []byte(key)
+		}
+	})
+	return artifactsKey
+}
+
+// The upload token of a run is derived from its id, so it does not need to be stored
+func getArtifactsToken(runId string) string {
+	return hex.EncodeToString(hmacSha256(getArtifactsKey(), runId))
+}
+
+func checkArtifactsToken(runId string, authorization string) bool {
+	if len(getArtifactsKey()) == 0 {
+		return false
+	}
+	token := strings.TrimPrefix(authorization, "Bearer ")
+	return hmac.Equal([]byte(token), []byte(getArtifactsToken(runId)))
+}
+
+func checkArtifacts(scmWorkflowDetails *ScmWorkflowDetails) error {
+	containers := scmWorkflowDetails.Workflow.WorkflowYaml.Workflow.Containers
+	downloads := scmWorkflowDetails.Workflow.WorkflowYaml.Workflow.DownloadArtifacts
+
+	names := map[string]bool{}
+	for _, container := range containers {
+		for _, artifact := range container.Artifacts {
+			if !artifactNameRegexp.MatchString(artifact.Name) {
+				return fmt.Errorf("container %q: invalid artifact name %q", container.Name, artifact.Name)
+			}
+			if names[artifact.Name] {
+				return fmt.Errorf("container %q: duplicate artifact name %q", container.Name, artifact.Name)
+			}
+			names[artifact.Name] = true
+			if len(artifact.Paths) == 0 {
+				return fmt.Errorf("container %q: artifact %q has no paths", container.Name, artifact.Name)
+			}
+			for _, path := range artifact.Paths {
+				if path == "" || strings.HasPrefix(path, "/") || strings.ContainsAny(path, " \t,") {
+					return fmt.Errorf("container %q: artifact path %q must be relative to /data, without spaces or commas", container.Name, path)
+				}
+			}
+		}
+	}
+
+	for i, download := range downloads {
+		if !artifactNameRegexp.MatchString(download.Name) || !artifactNameRegexp.MatchString(download.Workflow) {
+			return fmt.Errorf("workflow.downloadArtifacts[%d]: invalid workflow or artifact name", i)
+		}
+		if strings.HasPrefix(download.Path, "/") || strings.Contains(download.Path, "..") || strings.ContainsAny(download.Path, " \t") {
+			return fmt.Errorf("workflow.downloadArtifacts[%d]: path %q must be relative to /data, without spaces", i, download.Path)
+		}
+	}
+
+	if (len(names) > 0 || len(downloads) > 0) && artifactsApiUrl == "" {
+		return fmt.Errorf("artifacts need the ARTIFACTS_API_URL of the job generator to be configured")
+	}
+	return nil
+}
+
+// Returns the artifact-upload sidecar of the job, nil when no step declares artifacts
+func getArtifactUploadContainer(scmWorkflowDetails *ScmWorkflowDetails, jobName string) *apiv1.Container {
+	var lines []string
+	for i, container := range scmWorkflowDetails.Workflow.WorkflowYaml.Workflow.Containers {
+		for _, artifact := range container.Artifacts {
+			lines = append(lines, strings.Join([]string{strconv.Itoa(i), strconv.Itoa(i) + "-" + container.Name, artifact.Name, strings.Join(artifact.Paths, ",")}, " "))
+		}
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+
+	return &apiv1.Container{
+		Name:    "artifact-upload",
+		Image:   artifactHelperImage,
+		Command: []string{"sh", "-c", artifactUploadScript},
+		Env: []apiv1.EnvVar{
+			{Name: "AGNOPS_ARTIFACTS", Value: strings.Join(lines, "\n")},
+			{Name: "AGNOPS_ARTIFACTS_URL", Value: artifactsApiUrl + "/api/runs/" + jobName + "/artifacts"},
+			{Name: "AGNOPS_ARTIFACTS_TOKEN", Value: getArtifactsToken(jobName)},
+		},
+		VolumeMounts: []apiv1.VolumeMount{{MountPath: "/data", Name: "containers-data"}},
+	}
+}
+
+// Returns the artifact-download init container of the job, nil when the workflow downloads no artifact
+func getArtifactDownloadContainer(scmWorkflowDetails *ScmWorkflowDetails, jobName string) *apiv1.Container {
+	var lines []string
+	for _, download := range scmWorkflowDetails.Workflow.WorkflowYaml.Workflow.DownloadArtifacts {
+		path := download.Path
+		if path == "" {
+			path = "artifacts/" + download.Name
+		}
+		lines = append(lines, strings.Join([]string{download.Workflow, download.Name, path}, " "))
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+
+	return &apiv1.Container{
+		Name:    "artifact-download",
+		Image:   artifactHelperImage,
+		Command: []string{"sh", "-c", artifactDownloadScript},
+		Env: []apiv1.EnvVar{
+			{Name: "AGNOPS_DOWNLOADS", Value: strings.Join(lines, "\n")},
+			{Name: "AGNOPS_RUN_ID", Value: jobName},
+			{Name: "AGNOPS_ARTIFACTS_TOKEN", Value: getArtifactsToken(jobName)},
+			{Name: "AGNOPS_ARTIFACTS_API_URL", Value: artifactsApiUrl},
+		},
+		VolumeMounts: []apiv1.VolumeMount{{MountPath: "/data", Name: "containers-data"}},
+	}
+}
+
+// POST /api/runs/{id}/artifacts/{name}?step={step}, authenticated with the upload token of the run
+func uploadArtifact(w http.ResponseWriter, r *http.Request, runId string, name string) {
+	if !checkArtifactsToken(runId, r.Header.Get("Authorization")) {
+		writeJsonError(w, http.StatusUnauthorized, "invalid artifacts token")
+		return
+	}
+
+	writer, err := artifactStore.Create(runId, name)
+	if err != nil {
+		writeJsonError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	size, err := io.Copy(writer, http.MaxBytesReader(w, r.Body, int64(artifactMaxSizeMb)*1024*1024))
+	if closeErr := writer.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		writeJsonError(w, http.StatusBadRequest, "failed to store artifact "+name+": "+err.Error())
+		return
+	}
+
+	artifactRecord := ArtifactRecord{Name: name, Step: r.URL.Query().Get("step"), Size: size, UploadedAt: time.Now().UTC()}
+	err = updateRunRecord(runId, func(runRecord *RunRecord) {
+		artifacts := []ArtifactRecord{}
+		for _, artifact := range runRecord.Artifacts {
+			if artifact.Name != name {
+				artifacts = append(artifacts, artifact)
+			}
+		}
+		runRecord.Artifacts = append(artifacts, artifactRecord)
+	})
+	if err != nil {
+		writeJsonError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	log.Printf("Stored artifact %s of run %s, %d bytes\n", name, runId, size)
+	writeJson(w, http.StatusCreated, artifactRecord)
+}
+
+func writeArtifact(w http.ResponseWriter, runId string, name string) {
+	reader, err := artifactStore.Open(runId, name)
+	if os.IsNotExist(err) {
+		writeJsonError(w, http.StatusNotFound, "no artifact "+name+" for run "+runId)
+		return
+	}
+	if err != nil {
+		writeJsonError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer reader.Close()
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+name+".tar.gz\"")
+	if _, err := io.Copy(w, reader); err != nil {
+		failOnError(err, "Failed to send the artifact "+name+" of run "+runId)
+	}
+}
+
+// Authenticates an artifact download. A job pod sends the artifacts token of its run, given by the run query
+// parameter, and only reads the artifacts of its repository, the returned run record. Other clients send
+// API_ADMIN_TOKEN, the returned run record being nil. Writes the error and returns false when the request is refused
+func checkArtifactsDownload(w http.ResponseWriter, r *http.Request) (*RunRecord, bool) {
+	runId := r.URL.Query().Get("run")
+	if runId == "" {
+		return nil, checkAdminToken(w, r)
+	}
+	if !containerNameRegexp.MatchString(runId) || !checkArtifactsToken(runId, r.Header.Get("Authorization")) {
+		writeJsonError(w, http.StatusUnauthorized, "invalid artifacts token")
+		return nil, false
+	}
+	runRecord, err := getRunRecord(runId)
+	if err != nil {
+		writeJsonError(w, http.StatusUnauthorized, "run "+runId+" can not be read: "+err.Error())
+		return nil, false
+	}
+	return runRecord, true
+}
+
+// GET /api/artifacts?run=&workflow=&name=, the artifact of the most recent run of the workflow for the commit of the
+// requesting run which uploaded it, authenticated by checkArtifactsDownload. With API_ADMIN_TOKEN the org, repo and
+// commit query parameters replace the run
+func ArtifactsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJsonError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	query := r.URL.Query()
+	name := query.Get("name")
+	if !artifactNameRegexp.MatchString(name) {
+		writeJsonError(w, http.StatusBadRequest, "invalid artifact name")
+		return
+	}
+
+	requestingRun, ok := checkArtifactsDownload(w, r)
+	if !ok {
+		return
+	}
+	filter := runRecordFilter{Org: query.Get("org"), Repository: query.Get("repo"), CommitId: query.Get("commit")}
+	if requestingRun != nil {
+		filter = runRecordFilter{Org: requestingRun.Org, Repository: requestingRun.Repository, CommitId: requestingRun.CommitId}
+	}
+	if filter.Org == "" || filter.Repository == "" || filter.CommitId == "" {
+		writeJsonError(w, http.StatusBadRequest, "missing org, repo or commit")
+		return
+	}
+
+	runRecords, err := listRunRecords(filter)
+	if err != nil {
+		writeJsonError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	for _, runRecord := range runRecords {
+		if !strings.EqualFold(runRecord.Org, filter.Org) || !strings.EqualFold(runRecord.Repository, filter.Repository) ||
+			runRecord.CommitId != filter.CommitId || runRecord.ArtifactsExpired {
+			continue
+		}
+		workflow := strings.TrimSuffix(strings.TrimSuffix(runRecord.Workflow, ".yaml"), ".yml")
+		if runRecord.Workflow != query.Get("workflow") && workflow != query.Get("workflow") {
+			continue
+		}
+		for _, artifact := range runRecord.Artifacts {
+			if artifact.Name == name {
+				writeArtifact(w, runRecord.Id, name)
+				return
+			}
+		}
+	}
+	writeJsonError(w, http.StatusNotFound, "artifact "+name+" not found")
+}
+
+// Deletes the artifacts of the runs older than ARTIFACT_RETENTION_DAYS, their runs stay in the history
+func pruneRunArtifacts(runRecords []*RunRecord) {
+	oldest := time.Now().AddDate(0, 0, -artifactRetentionDays)
+	for _, runRecord := range runRecords {
+		if len(runRecord.Artifacts) == 0 || runRecord.ArtifactsExpired || !runRecord.CreatedAt.Before(oldest) {
+			continue
+		}
+		if err := artifactStore.Delete(runRecord.Id); err != nil {
+			failOnError(err, "Failed to delete the artifacts of run "+runRecord.Id)
+			continue
+		}
+		err := updateRunRecord(runRecord.Id, func(runRecord *RunRecord) {
+			runRecord.ArtifactsExpired = true
+		})
+		failOnError(err, "Failed to record the expiry of the artifacts of run "+runRecord.Id)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	apiv1 "k8s.io/api/core/v1"
+)
+
+// Image builders selectable with addOns.builder. isDocker is the docker-socket builder
+const (
+	BuilderDockerSocket = "docker-socket"
+	BuilderDind         = "dind"
+	BuilderBuildKit     = "buildkit"
+	BuilderKaniko       = "kaniko"
+)
+
+// The host Docker socket builder gives root on the node, ALLOW_HOST_DOCKER_SOCKET=false rejects it
+var allowHostDockerSocket = os.Getenv("ALLOW_HOST_DOCKER_SOCKET") != "false"
+
+var dindImage = getEnvString("DIND_IMAGE", "docker:dind-rootless")
+var buildKitImage = getEnvString("BUILDKIT_IMAGE", "moby/buildkit:rootless")
+var kanikoImage = getEnvString("KANIKO_IMAGE", "gcr.io/kaniko-project/executor:debug")
+
+// The dind client certificates are shared with the steps through the data volume
+const dindCertsDir = "/data/.agnops/docker-certs"
+
+func getContainerBuilder(container WorkflowContainer) string {
+	if container.AddOns.Builder != "" {
+		return container.AddOns.Builder
+	}
+	if container.AddOns.IsDocker {
+		return BuilderDockerSocket
+	}
+	return ""
+}
+
+func checkBuilder(container WorkflowContainer) error {
+	switch getContainerBuilder(container) {
+	case "", BuilderDind, BuilderBuildKit, BuilderKaniko:
+		return nil
+	case BuilderDockerSocket:
+		if !allowHostDockerSocket {
+			return fmt.Errorf("container %q: the host Docker socket is disabled, use the %s, %s or %s builder", container.Name, BuilderDind, BuilderBuildKit, BuilderKaniko)
+		}
+		return nil
+	}
+	return fmt.Errorf("container %q: unknown builder %q", container.Name, container.AddOns.Builder)
+}
+
+// Returns the environment giving a step access to the builder sidecar
+func getBuilderEnvs(builder string) []apiv1.EnvVar {
+	switch builder {
+	case BuilderDind:
+		return []apiv1.EnvVar{
+			{Name: "DOCKER_HOST", Value: "tcp://127.0.0.1:2376"},
+			{Name: "DOCKER_TLS_VERIFY", Value: "1"},
+			{Name: "DOCKER_CERT_PATH", Value: dindCertsDir + "/client"},
+		}
+	case BuilderBuildKit:
+		return []apiv1.EnvVar{{Name: "BUILDKIT_HOST", Value: "tcp://127.0.0.1:1234"}}
+	}
+	return nil
+}
+
+func getBuilderSidecarName(builder string) string {
+	return "builder-" + builder
+}
+
+// Returns the sidecar running the daemon of the builder, nil for the builders without a daemon. Rootless dockerd
+// still needs a privileged container to set up its user namespaces, allowed by the privileged security exception,
+// but runs as an unprivileged user without any host mount. Rootless BuildKit only needs seccomp and AppArmor to be
+// unconfined, see getBuilderPodAnnotations
+func getBuilderSidecar(builder string, stepsCount int) *apiv1.Container {
+	rootlessUser := int64(1000)
+	privileged := true
+
+	switch builder {
+	case BuilderDind:
+		env := append(getBuilderEnvs(builder), apiv1.EnvVar{Name: "DOCKER_TLS_CERTDIR", Value: dindCertsDir})
+		sidecar := getSidecarContainer(getBuilderSidecarName(builder), dindImage, "dockerd-entrypoint.sh", "docker info", stepsCount, env)
+		sidecar.SecurityContext = &apiv1.SecurityContext{Privileged: &privileged, RunAsUser: &rootlessUser}
+		return &sidecar
+	case BuilderBuildKit:
+		sidecar := getSidecarContainer(getBuilderSidecarName(builder), buildKitImage,
+			"rootlesskit buildkitd --oci-worker-no-process-sandbox --addr tcp://127.0.0.1:1234",
+			"buildctl --addr tcp://127.0.0.1:1234 debug workers", stepsCount, nil)
+		sidecar.SecurityContext = &apiv1.SecurityContext{RunAsUser: &rootlessUser, RunAsGroup: &rootlessUser}
+		return &sidecar
+	}
+	return nil
+}
+
+func getBuilderPodAnnotations(builder string) map[string]string {
+	if builder != BuilderBuildKit {
+		return nil
+	}
+	sidecarName := getBuilderSidecarName(builder)
+	return map[string]string{
+		"container.apparmor.security.beta.kubernetes.io/" + sidecarName: "unconfined",
+		"container.seccomp.security.alpha.kubernetes.io/" + sidecarName: "unconfined",
+	}
+}
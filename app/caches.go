@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Caches of a repository live in one PersistentVolumeClaim shared by all of its branches, so a branch restores the
+// entries saved by another one through restoreKeys. Concurrent jobs only write to their own working directories and
+// replace entries under a lock, see cacheRestoreScript and cacheSaveScript. With ReadWriteOnce the volume is mounted
+// by a single node at a time: the jobs of a repository scheduled on another node stay pending until the jobs using it
+// finished, ReadWriteMany storage classes avoid it
+var cacheVolumeSize = getEnvString("CACHE_VOLUME_SIZE", "10Gi")
+var cacheStorageClass = os.Getenv("CACHE_STORAGE_CLASS")
+var cacheAccessMode = getEnvString("CACHE_ACCESS_MODE", string(apiv1.ReadWriteOnce))
+var cacheHelperImage = getEnvString("CACHE_HELPER_IMAGE", "busybox:1.32")
+
+// Cache entries unused for CACHE_MAX_AGE_DAYS are evicted, then the least recently used ones until the volume holds
+// less than CACHE_MAX_SIZE_MB, 90% of the volume by default
+var cacheMaxAgeDays = getEnvInt("CACHE_MAX_AGE_DAYS", 7)
+var cacheMaxSizeMb = getEnvInt("CACHE_MAX_SIZE_MB", 0)
+
+const cacheMountPath = "/agnops/cache"
+const cacheKeysDir = "/data/.agnops/caches"
+const cacheWorkDirsDir = "/data/.agnops/cache-dirs"
+
+var cacheNameRegexp = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
+var cacheKeyInvalidRegexp = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// A cache restored before the steps and linked at its paths in every step. The key, suffixed by the hash of the
+// hashFiles of the repository, selects the cache entry. A missing entry starts from the most recent entry whose key
+// starts with one of restoreKeys
+type WorkflowCache struct {
+	Name        string   `yaml:"name"`
+	Paths       []string `yaml:"paths"`
+	Key         string   `yaml:"key"`
+	HashFiles   []string `yaml:"hashFiles"`
+	RestoreKeys []string `yaml:"restoreKeys"`
+}
+
+// Shell functions of the cache containers. An entry is only read, replaced or evicted while holding its lock, a
+// hidden directory next to it. A lock older than 30 minutes was left by a killed pod
+const cacheLockFunctions = `
+lock() {
+  until mkdir $(dirname $1)/.$(basename $1).lock 2>/dev/null; do
+    find $(dirname $1) -maxdepth 1 -name ".$(basename $1).lock" -mmin +30 -exec rmdir {} \; 2>/dev/null
+    sleep 1
+  done
+}
+
+unlock() {
+  rmdir $(dirname $1)/.$(basename $1).lock
+}
+`
+
+// Entrypoint of the cache-restore init container. Each line of AGNOPS_CACHES holds the name, key, hashFiles and
+// restoreKeys of a cache, - standing for an empty list. The entry of the resolved key, or of the most recent restore
+// key, is copied to a working directory of the job written to cacheWorkDirsDir, so concurrent jobs of the same key
+// do not write to the same files. The resolved key of every cache is written to cacheKeysDir, then the old and least
+// recently used entries are evicted
+const cacheRestoreScript = `
+root=` + cacheMountPath + `
+keys=` + cacheKeysDir + `
+work_dirs=` + cacheWorkDirsDir + `
+mkdir -p $keys $work_dirs
+chmod 777 $keys $work_dirs 2>/dev/null
+` + cacheLockFunctions + `
+echo "$AGNOPS_CACHES" | while read -r name key hash_files restore_keys; do
+  [ -z "$name" ] && continue
+  if [ "$hash_files" != "-" ]; then
+    hash=$(set -f; cd /data/repo && for pattern in $(echo "$hash_files" | tr , ' '); do find . -type f -path "./$pattern"; done | sort | xargs cat 2>/dev/null | sha256sum | cut -c1-16)
+    key=$key-$hash
+  fi
+  mkdir -p $root/$name
+  work=$(mktemp -d $root/$name/.$key.XXXXXX) || exit 1
+  match=
+  if [ -d $root/$name/$key ]; then
+    match=$root/$name/$key
+    echo "agnops: cache $name restored from key $key"
+  else
+    for restore_key in $(echo $restore_keys | tr , ' '); do
+      [ "$restore_key" = "-" ] && break
+      match=$(ls -dt $root/$name/$restore_key* 2>/dev/null | head -1)
+      if [ -n "$match" ]; then
+        echo "agnops: cache $name restored from key $(basename $match) for key $key"
+        break
+      fi
+    done
+    [ -z "$match" ] && echo "agnops: cache $name missed for key $key"
+  fi
+  if [ -n "$match" ]; then
+    lock $match
+    [ -d $match ] && touch $match && cp -a $match/. $work/
+    unlock $match
+  fi
+  echo $key > $keys/$name
+  echo $work > $work_dirs/$name
+done || exit 1
+
+find $root -mindepth 2 -maxdepth 2 -type d -mtime +$AGNOPS_CACHE_MAX_AGE_DAYS -exec rm -rf {} \;
+for entry in $(ls -dtr $root/*/* 2>/dev/null); do
+  [ $(du -sk $root | cut -f1) -le $AGNOPS_CACHE_MAX_SIZE_KB ] && break
+  in_use=
+  for name in $(ls $keys); do
+    [ "$entry" = "$root/$name/$(cat $keys/$name)" ] && in_use=true
+  done
+  [ -n "$in_use" ] && continue
+  echo "agnops: evicting cache entry $entry"
+  lock $entry
+  rm -rf $entry
+  unlock $entry
+done
+exit 0
+`
+
+// Entrypoint of the cache-save sidecar. Once every step of AGNOPS_CACHE_STEPS recorded its exit code, the working
+// directory of each cache replaces the entry of its key with a rename, so a job restoring the key copies either the
+// previous or the new entry. The entry is saved whatever the outcome of the steps, a failed steps rerun relying on
+// the outputs of the steps which succeeded
+const cacheSaveScript = `
+root=` + cacheMountPath + `
+steps=` + stepsDir + `
+keys=` + cacheKeysDir + `
+work_dirs=` + cacheWorkDirsDir + `
+` + stepWaitFunctions + cacheLockFunctions + `
+for step in $AGNOPS_CACHE_STEPS; do
+  wait_for $step exit
+done
+
+status=0
+for name in $(ls $keys); do
+  dir=$root/$name/$(cat $keys/$name)
+  work=$(cat $work_dirs/$name)
+  old=$work.old
+  lock $dir
+  [ -d $dir ] && mv $dir $old
+  if mv $work $dir; then
+    echo "agnops: cache $name saved to key $(basename $dir)"
+  else
+    echo "agnops: failed to save cache $name to key $(basename $dir)"
+    status=1
+  fi
+  unlock $dir
+  rm -rf $old $work
+done
+exit $status
+`
+
+func getCacheKey(value string) string {
+	return strings.Trim(cacheKeyInvalidRegexp.ReplaceAllString(value, "-"), "-")
+}
+
+func checkCaches(caches []WorkflowCache) error {
+	names := map[string]bool{}
+	for i, cache := range caches {
+		if !cacheNameRegexp.MatchString(cache.Name) {
+			return fmt.Errorf("workflow.cache[%d]: name %q must be lowercase letters, digits and dashes", i, cache.Name)
+		}
+		if names[cache.Name] {
+			return fmt.Errorf("workflow.cache[%d]: duplicate cache name %q", i, cache.Name)
+		}
+		names[cache.Name] = true
+		if len(cache.Paths) == 0 {
+			return fmt.Errorf("workflow.cache[%d]: cache %q has no paths", i, cache.Name)
+		}
+		for _, path := range cache.Paths {
+			if !strings.HasPrefix(path, "/") || strings.ContainsAny(path, " \t:") {
+				return fmt.Errorf("workflow.cache[%d]: path %q must be absolute, without spaces or colons", i, path)
+			}
+		}
+		for _, pattern := range cache.HashFiles {
+			if pattern == "" || strings.ContainsAny(pattern, " \t,") {
+				return fmt.Errorf("workflow.cache[%d]: hashFiles pattern %q must not be empty or contain spaces or commas", i, pattern)
+			}
+		}
+	}
+	return nil
+}
+
+// Returns the caches as lines of name, key, hashFiles and restoreKeys, the key defaulting to the branch
+func getCachesEnv(scmWorkflowDetails *ScmWorkflowDetails) string {
+	var lines []string
+	for _, cache := range scmWorkflowDetails.Workflow.WorkflowYaml.Workflow.Caches {
+		key := getCacheKey(cache.Key)
+		if key == "" {
+			key = getCacheKey(scmWorkflowDetails.Branch + scmWorkflowDetails.Tag)
+		}
+		hashFiles := strings.Join(cache.HashFiles, ",")
+		if hashFiles == "" {
+			hashFiles = "-"
+		}
+		var restoreKeys []string
+		for _, restoreKey := range cache.RestoreKeys {
+			if restoreKey = getCacheKey(restoreKey); restoreKey != "" {
+				restoreKeys = append(restoreKeys, restoreKey)
+			}
+		}
+		if len(restoreKeys) == 0 {
+			restoreKeys = []string{"-"}
+		}
+		lines = append(lines, strings.Join([]string{cache.Name, key, hashFiles, strings.Join(restoreKeys, ",")}, " "))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Returns the name:index:path of every cache path, linked by the step runner to the working directory of the cache
+func getStepCachesEnv(caches []WorkflowCache) string {
+	var stepCaches []string
+	for _, cache := range caches {
+		for i, path := range cache.Paths {
+			stepCaches = append(stepCaches, cache.Name+":"+strconv.Itoa(i)+":"+path)
+		}
+	}
+	return strings.Join(stepCaches, " ")
+}
+
+func getCacheVolumeName(scmWorkflowDetails *ScmWorkflowDetails) string {
+	repository := scmWorkflowDetails.ScProvider + "/" + scmWorkflowDetails.GitOrgProject + "/" + scmWorkflowDetails.GitRepository
+	hash := sha1.Sum([]byte(repository))
+	prefix := sanitizeName(scmWorkflowDetails.GitOrgProject + "-" + scmWorkflowDetails.GitRepository)
+	if len(prefix) > 40 {
+		prefix = strings.TrimRight(prefix[:40], "-")
+	}
+	return "agnops-cache-" + prefix + "-" + hex.EncodeToString(hash[:])[:8]
+}
+
+func getCacheMaxSizeKb() int64 {
+	if cacheMaxSizeMb > 0 {
+		return int64(cacheMaxSizeMb) * 1024
+	}
+	volumeSize := resource.MustParse(cacheVolumeSize)
+	return volumeSize.Value() / 1024 * 9 / 10
+}
+
+// Creates the cache volume of the repository when it does not exist yet
+func ensureCacheVolume(scmWorkflowDetails *ScmWorkflowDetails) error {
+	claimsClient := clientset.CoreV1().PersistentVolumeClaims(namespace)
+	claimName := getCacheVolumeName(scmWorkflowDetails)
+	_, err := claimsClient.Get(context.TODO(), claimName, metav1.GetOptions{})
+	if err == nil || !errors.IsNotFound(err) {
+		return err
+	}
+
+	claim := &apiv1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      claimName,
+			Namespace: namespace,
+			Labels:    map[string]string{"AgnOps": "cache"},
+			Annotations: map[string]string{
+				"agnops/provider":   scmWorkflowDetails.ScProvider,
+				"agnops/org":        scmWorkflowDetails.GitOrgProject,
+				"agnops/repository": scmWorkflowDetails.GitRepository,
+			},
+		},
+		Spec: apiv1.PersistentVolumeClaimSpec{
+			AccessModes: []apiv1.PersistentVolumeAccessMode{apiv1.PersistentVolumeAccessMode(cacheAccessMode)},
+			Resources: apiv1.ResourceRequirements{
+				Requests: apiv1.ResourceList{apiv1.ResourceStorage: resource.MustParse(cacheVolumeSize)},
+			},
+		},
+	}
+	if cacheStorageClass != "" {
+		claim.Spec.StorageClassName = &cacheStorageClass
+	}
+
+	_, err = claimsClient.Create(context.TODO(), claim, metav1.CreateOptions{})
+	if errors.IsAlreadyExists(err) {
+		return nil
+	}
+	if err == nil {
+		log.Printf("Created cache volume %s\n", claimName)
+	}
+	return err
+}
+
+func getCacheVolume(scmWorkflowDetails *ScmWorkflowDetails) apiv1.Volume {
+	return apiv1.Volume{Name: "agnops-cache", VolumeSource: apiv1.VolumeSource{PersistentVolumeClaim: &apiv1.PersistentVolumeClaimVolumeSource{ClaimName: getCacheVolumeName(scmWorkflowDetails)}}}
+}
+
+func getCacheRestoreContainer(scmWorkflowDetails *ScmWorkflowDetails) apiv1.Container {
+	return apiv1.Container{
+		Name:    "cache-restore",
+		Image:   cacheHelperImage,
+		Command: []string{"sh", "-c", cacheRestoreScript},
+		Env: []apiv1.EnvVar{
+			{Name: "AGNOPS_CACHES", Value: getCachesEnv(scmWorkflowDetails)},
+			{Name: "AGNOPS_CACHE_MAX_AGE_DAYS", Value: strconv.Itoa(cacheMaxAgeDays)},
+			{Name: "AGNOPS_CACHE_MAX_SIZE_KB", Value: strconv.FormatInt(getCacheMaxSizeKb(), 10)},
+		},
+		VolumeMounts: []apiv1.VolumeMount{{MountPath: "/data", Name: "containers-data"}, {MountPath: cacheMountPath, Name: "agnops-cache"}},
+	}
+}
+
+// Returns the cache-save sidecar, which saves the caches once the steps finished
+func getCacheSaveContainer(stepsCount int) apiv1.Container {
+	var steps []string
+	for i := 0; i < stepsCount; i++ {
+		steps = append(steps, strconv.Itoa(i))
+	}
+
+	return apiv1.Container{
+		Name:         "cache-save",
+		Image:        cacheHelperImage,
+		Command:      []string{"sh", "-c", cacheSaveScript},
+		Env:          []apiv1.EnvVar{{Name: "AGNOPS_CACHE_STEPS", Value: strings.Join(steps, " ")}},
+		VolumeMounts: []apiv1.VolumeMount{{MountPath: "/data", Name: "containers-data"}, {MountPath: cacheMountPath, Name: "agnops-cache"}},
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+)
+
+// Link of the reported statuses, {job} and {namespace} are replaced. Defaults to the commit URL
+var statusTargetUrl = os.Getenv("STATUS_TARGET_URL")
+var commitStatusRetries = getEnvInt("COMMIT_STATUS_RETRIES", 5)
+
+type commitStatus struct {
+	Provider    string
+	Org         string
+	Repository  string
+	ProjectId   string
+	CommitId    string
+	Context     string
+	State       string
+	Description string
+	TargetUrl   string
+}
+
+// Statuses are posted by a single goroutine, so the states of a job reach the SCM in order
+var commitStatusQueue = make(chan commitStatus, 1000)
+
+var jobStateDescriptions = map[string]string{
+	JobQueued:    "Waiting for a free job slot",
+	JobPending:   "Waiting for the job to start",
+	JobRunning:   "Job is running",
+	JobSucceeded: "Job succeeded",
+	JobFailed:    "Job failed",
+	JobCancelled: "Job was cancelled",
+	JobSkipped:   "Skipped, every container was skipped by its when conditions",
+}
+
+func getJobCommitStatus(job *batchv1.Job, state string) commitStatus {
+	statusContext := "agnops/" + job.Annotations["agnops/workflow"]
+	if matrix := job.Annotations["agnops/matrix"]; matrix != "" {
+		statusContext += " (" + matrix + ")"
+	}
+
+	description := jobStateDescriptions[state]
+	if state == JobFailed {
+		if failedContainer := getFailedContainer(job); failedContainer != "" {
+			description += ", container " + failedContainer + " failed"
+		}
+	}
+
+	targetUrl := job.Annotations["agnops/commit-url"]
+	if statusTargetUrl != "" {
+		targetUrl = strings.NewReplacer("{job}", job.Name, "{namespace}", job.Namespace).Replace(statusTargetUrl)
+	}
+
+	return commitStatus{
+		Provider:    job.Annotations["agnops/provider"],
+		Org:         job.Annotations["agnops/org"],
+		Repository:  job.Annotations["agnops/repository"],
+		ProjectId:   job.Annotations["agnops/project-id"],
+		CommitId:    job.Annotations["agnops/commit"],
+		Context:     statusContext,
+		State:       state,
+		Description: description,
+		TargetUrl:   targetUrl,
+	}
+}
+
+// Reports a workflow whose containers were all skipped, which has no job
+func queueSkippedCommitStatus(scmWorkflowDetails *ScmWorkflowDetails, runId string) {
+	statusContext := "agnops/" + scmWorkflowDetails.Workflow.FileName
+	if matrix := getMatrixDescription(scmWorkflowDetails.Matrix); matrix != "" {
+		statusContext += " (" + matrix + ")"
+	}
+	targetUrl := scmWorkflowDetails.CommitUrl
+	if statusTargetUrl != "" {
+		targetUrl = strings.NewReplacer("{job}", runId, "{namespace}", namespace).Replace(statusTargetUrl)
+	}
+
+	commitStatusQueue <- commitStatus{
+		Provider:    scmWorkflowDetails.ScProvider,
+		Org:         scmWorkflowDetails.GitOrgProject,
+		Repository:  scmWorkflowDetails.GitRepository,
+		ProjectId:   scmWorkflowDetails.ProjectId,
+		CommitId:    scmWorkflowDetails.CommitId,
+		Context:     statusContext,
+		State:       JobSkipped,
+		Description: jobStateDescriptions[JobSkipped],
+		TargetUrl:   targetUrl,
+	}
+}
+
+func queueJobCommitStatus(job *batchv1.Job, state string) {
+	commitStatusQueue <- getJobCommitStatus(job, state)
+}
+
+func postCommitStatus(status commitStatus) error {
+	switch status.Provider {
+	case "GitHub":
+		return postGitHubCommitStatus(status)
+	case "GitLab":
+		return postGitLabCommitStatus(status)
+	}
+	return nil
+}
+
+// Error of an SCM API request answered with a status code of 300 or more
+type scmResponseError struct {
+	Method     string
+	Url        string
+	StatusCode int
+	Body       []byte
+}
+
+func (err *scmResponseError) Error() string {
+	return fmt.Sprintf("%s %s returned %d: %s", err.Method, err.Url, err.StatusCode, err.Body)
+}
+
+// Server errors and network failures may pass on a new attempt, a rejected status would be rejected again
+func isRetryableCommitStatusError(err error) bool {
+	var responseError *scmResponseError
+	if errors.As(err, &responseError) {
+		return responseError.StatusCode >= 500
+	}
+	var netError net.Error
+	return errors.As(err, &netError)
+}
+
+func getCommitStatusKey(status commitStatus) string {
+	return status.Provider + "/" + status.Org + "/" + status.Repository + "@" + status.CommitId + "/" + status.Context
+}
+
+type commitStatusAttempt struct {
+	Status  commitStatus
+	Attempt int
+}
+
+// Failed posts wait for their backoff timer here, so the statuses of other commits are not held up meanwhile
+var commitStatusRetryQueue = make(chan commitStatusAttempt, 1000)
+
+// Posts the status, then the statuses of the same context queued meanwhile. A retryable failure schedules the next
+// attempt with an exponential backoff, the later statuses of the context waiting for it in waiting
+func postCommitStatusAttempt(statusAttempt commitStatusAttempt, waiting map[string][]commitStatus) {
+	key := getCommitStatusKey(statusAttempt.Status)
+	for {
+		status := statusAttempt.Status
+		err := postCommitStatus(status)
+		if err != nil {
+			log.Printf("Failed to report the %s status of %s@%s, attempt %d: %s\n", status.Context, status.Repository, status.CommitId, statusAttempt.Attempt, err)
+			if statusAttempt.Attempt < commitStatusRetries && isRetryableCommitStatusError(err) {
+				if _, ok := waiting[key]; !ok {
+					waiting[key] = []commitStatus{}
+				}
+				backoff := time.Second << uint(statusAttempt.Attempt-1)
+				next := commitStatusAttempt{Status: status, Attempt: statusAttempt.Attempt + 1}
+				time.AfterFunc(backoff, func() { commitStatusRetryQueue <- next })
+				return
+			}
+		}
+
+		if len(waiting[key]) == 0 {
+			delete(waiting, key)
+			return
+		}
+		statusAttempt = commitStatusAttempt{Status: waiting[key][0], Attempt: 1}
+		waiting[key] = waiting[key][1:]
+	}
+}
+
+// Statuses of one context are posted in order, a status waiting for a retry holding back the later ones
+func reportCommitStatuses() {
+	waiting := map[string][]commitStatus{}
+	for {
+		select {
+		case status := <-commitStatusQueue:
+			key := getCommitStatusKey(status)
+			if backlog, ok := waiting[key]; ok {
+				waiting[key] = append(backlog, status)
+				continue
+			}
+			postCommitStatusAttempt(commitStatusAttempt{Status: status, Attempt: 1}, waiting)
+		case statusAttempt := <-commitStatusRetryQueue:
+			postCommitStatusAttempt(statusAttempt, waiting)
+		}
+	}
+}
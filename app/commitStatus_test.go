@@ -0,0 +1,272 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+type postedStatus struct {
+	Path          string
+	Authorization string
+	Body          map[string]string
+}
+
+// Serves the status endpoint of path with statusCode, recording the posted statuses
+func newStatusServer(t *testing.T, path string, statusCode int, routes map[string]interface{}) (*httptest.Server, *[]postedStatus) {
+	var posted []postedStatus
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if response, ok := routes[r.URL.Path]; ok {
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+		if r.Method != "POST" || r.URL.Path != path {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		status := postedStatus{Path: r.URL.Path, Authorization: r.Header.Get("Authorization")}
+		if err := json.NewDecoder(r.Body).Decode(&status.Body); err != nil {
+			t.Errorf("invalid status body: %s", err)
+		}
+		posted = append(posted, status)
+		w.WriteHeader(statusCode)
+	}))
+	return server, &posted
+}
+
+func setGitHubApp(t *testing.T, apiUrl string) func() {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "agnops")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPath := filepath.Join(dir, "key.pem")
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	if err := ioutil.WriteFile(keyPath, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	previousApiUrl, previousAppId, previousKeyPath := githubApiUrl, githubAppId, githubAppPrivateKeyPath
+	githubApiUrl, githubAppId, githubAppPrivateKeyPath = apiUrl, "1", keyPath
+	githubInstallationTokens = map[string]githubInstallationToken{}
+	return func() {
+		githubApiUrl, githubAppId, githubAppPrivateKeyPath = previousApiUrl, previousAppId, previousKeyPath
+		os.RemoveAll(dir)
+	}
+}
+
+func TestPostGitHubCommitStatus(t *testing.T) {
+	routes := map[string]interface{}{
+		"/repos/agnops/job-generator/installation": map[string]interface{}{"id": 42},
+		"/app/installations/42/access_tokens":      map[string]interface{}{"token": "installation-token", "expires_at": time.Now().Add(time.Hour)},
+	}
+	tests := []struct {
+		name       string
+		state      string
+		statusCode int
+		wantState  string
+		wantErr    bool
+	}{
+		{name: "running", state: JobRunning, statusCode: http.StatusCreated, wantState: "pending"},
+		{name: "succeeded", state: JobSucceeded, statusCode: http.StatusCreated, wantState: "success"},
+		{name: "failed", state: JobFailed, statusCode: http.StatusCreated, wantState: "failure"},
+		{name: "cancelled", state: JobCancelled, statusCode: http.StatusCreated, wantState: "error"},
+		{name: "skipped", state: JobSkipped, statusCode: http.StatusCreated, wantState: "success"},
+		{name: "rejected", state: JobRunning, statusCode: http.StatusUnprocessableEntity, wantState: "pending", wantErr: true},
+		{name: "server error", state: JobRunning, statusCode: http.StatusBadGateway, wantState: "pending", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server, posted := newStatusServer(t, "/repos/agnops/job-generator/statuses/0123456789abcdef", test.statusCode, routes)
+			defer server.Close()
+			defer setGitHubApp(t, server.URL)()
+
+			err := postCommitStatus(commitStatus{
+				Provider:    "GitHub",
+				Org:         "agnops",
+				Repository:  "job-generator",
+				CommitId:    "0123456789abcdef",
+				Context:     "agnops/build.yaml",
+				State:       test.state,
+				Description: jobStateDescriptions[test.state],
+				TargetUrl:   "https://example.com/runs/1",
+			})
+			if (err != nil) != test.wantErr {
+				t.Fatalf("got error %v, want an error %t", err, test.wantErr)
+			}
+			if len(*posted) != 1 {
+				t.Fatalf("got %d posted statuses, want 1", len(*posted))
+			}
+			status := (*posted)[0]
+			if status.Authorization != "token installation-token" {
+				t.Errorf("got authorization %q", status.Authorization)
+			}
+			want := map[string]string{
+				"state":       test.wantState,
+				"context":     "agnops/build.yaml",
+				"description": jobStateDescriptions[test.state],
+				"target_url":  "https://example.com/runs/1",
+			}
+			for key, value := range want {
+				if status.Body[key] != value {
+					t.Errorf("got %s %q, want %q", key, status.Body[key], value)
+				}
+			}
+		})
+	}
+}
+
+func TestPostGitHubCommitStatusTruncatesDescription(t *testing.T) {
+	routes := map[string]interface{}{
+		"/repos/agnops/job-generator/installation": map[string]interface{}{"id": 42},
+		"/app/installations/42/access_tokens":      map[string]interface{}{"token": "installation-token", "expires_at": time.Now().Add(time.Hour)},
+	}
+	server, posted := newStatusServer(t, "/repos/agnops/job-generator/statuses/0123456789abcdef", http.StatusCreated, routes)
+	defer server.Close()
+	defer setGitHubApp(t, server.URL)()
+
+	description := ""
+	for len(description) < 200 {
+		description += "container failed, "
+	}
+	err := postCommitStatus(commitStatus{Provider: "GitHub", Org: "agnops", Repository: "job-generator", CommitId: "0123456789abcdef", State: JobFailed, Description: description})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len((*posted)[0].Body["description"]) != 140 {
+		t.Errorf("got a description of %d characters, want 140", len((*posted)[0].Body["description"]))
+	}
+}
+
+func TestPostGitLabCommitStatus(t *testing.T) {
+	previousSecretsClient, previousScmProvider, previousApiUrl := secretsClient, scmProvider, gitlabApiUrl
+	defer func() {
+		secretsClient, scmProvider, gitlabApiUrl = previousSecretsClient, previousScmProvider, previousApiUrl
+	}()
+	scmProvider = "GitLab"
+	secretsClient = fake.NewSimpleClientset(&apiv1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "agnops-gitlab-agnops", Namespace: namespace},
+		Data:       map[string][]byte{"OAuth2Token": []byte("oauth-token")},
+	}).CoreV1().Secrets(namespace)
+
+	tests := []struct {
+		name       string
+		state      string
+		targetUrl  string
+		statusCode int
+		wantState  string
+		wantErr    bool
+	}{
+		{name: "pending", state: JobPending, statusCode: http.StatusCreated, wantState: "pending"},
+		{name: "running", state: JobRunning, targetUrl: "https://example.com/runs/1", statusCode: http.StatusCreated, wantState: "running"},
+		{name: "succeeded", state: JobSucceeded, statusCode: http.StatusCreated, wantState: "success"},
+		{name: "failed", state: JobFailed, statusCode: http.StatusCreated, wantState: "failed"},
+		{name: "cancelled", state: JobCancelled, statusCode: http.StatusCreated, wantState: "canceled"},
+		{name: "skipped", state: JobSkipped, statusCode: http.StatusCreated, wantState: "skipped"},
+		{name: "rejected", state: JobRunning, statusCode: http.StatusBadRequest, wantState: "running", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server, posted := newStatusServer(t, "/projects/7/statuses/0123456789abcdef", test.statusCode, nil)
+			defer server.Close()
+			gitlabApiUrl = server.URL
+
+			err := postCommitStatus(commitStatus{
+				Provider:    "GitLab",
+				Org:         "agnops",
+				Repository:  "job-generator",
+				ProjectId:   "7",
+				CommitId:    "0123456789abcdef",
+				Context:     "agnops/build.yaml",
+				State:       test.state,
+				Description: jobStateDescriptions[test.state],
+				TargetUrl:   test.targetUrl,
+			})
+			if (err != nil) != test.wantErr {
+				t.Fatalf("got error %v, want an error %t", err, test.wantErr)
+			}
+			if len(*posted) != 1 {
+				t.Fatalf("got %d posted statuses, want 1", len(*posted))
+			}
+			status := (*posted)[0]
+			if status.Authorization != "Bearer oauth-token" {
+				t.Errorf("got authorization %q", status.Authorization)
+			}
+			if status.Body["state"] != test.wantState || status.Body["name"] != "agnops/build.yaml" {
+				t.Errorf("got state %q and name %q", status.Body["state"], status.Body["name"])
+			}
+			if targetUrl, ok := status.Body["target_url"]; ok != (test.targetUrl != "") || targetUrl != test.targetUrl {
+				t.Errorf("got target_url %q, want %q", targetUrl, test.targetUrl)
+			}
+		})
+	}
+}
+
+func TestIsRetryableCommitStatusError(t *testing.T) {
+	_, networkError := http.Get("http://127.0.0.1:1")
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "server error", err: &scmResponseError{StatusCode: http.StatusBadGateway}, want: true},
+		{name: "wrapped server error", err: fmt.Errorf("posting: %w", &scmResponseError{StatusCode: http.StatusServiceUnavailable}), want: true},
+		{name: "rejected status", err: &scmResponseError{StatusCode: http.StatusUnprocessableEntity}, want: false},
+		{name: "missing permission", err: &scmResponseError{StatusCode: http.StatusForbidden}, want: false},
+		{name: "network error", err: networkError, want: true},
+		{name: "other error", err: errors.New("no PEM data"), want: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := isRetryableCommitStatusError(test.err); got != test.want {
+				t.Errorf("isRetryableCommitStatusError(%v) = %t, want %t", test.err, got, test.want)
+			}
+		})
+	}
+}
+
+func TestPostCommitStatusAttemptKeepsOrder(t *testing.T) {
+	routes := map[string]interface{}{
+		"/repos/agnops/job-generator/installation": map[string]interface{}{"id": 42},
+		"/app/installations/42/access_tokens":      map[string]interface{}{"token": "installation-token", "expires_at": time.Now().Add(time.Hour)},
+	}
+	server, posted := newStatusServer(t, "/repos/agnops/job-generator/statuses/0123456789abcdef", http.StatusUnprocessableEntity, routes)
+	defer server.Close()
+	defer setGitHubApp(t, server.URL)()
+
+	status := commitStatus{Provider: "GitHub", Org: "agnops", Repository: "job-generator", CommitId: "0123456789abcdef", Context: "agnops/build.yaml"}
+	pending, failed := status, status
+	pending.State, failed.State = JobPending, JobFailed
+	waiting := map[string][]commitStatus{getCommitStatusKey(status): {failed}}
+
+	// A rejected status is not retried, the next status of the context is posted right away
+	postCommitStatusAttempt(commitStatusAttempt{Status: pending, Attempt: 1}, waiting)
+	if len(*posted) != 2 || (*posted)[0].Body["state"] != "pending" || (*posted)[1].Body["state"] != "failure" {
+		t.Fatalf("got posted statuses %v", *posted)
+	}
+	if len(waiting) != 0 || len(commitStatusRetryQueue) != 0 {
+		t.Errorf("a rejected status was kept for a retry")
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Jobs of one concurrency group, with cancelInProgress, cancel the running jobs of the group created for other commits
+type WorkflowConcurrency struct {
+	Group            string `yaml:"group"`
+	CancelInProgress bool   `yaml:"cancelInProgress"`
+}
+
+// Returns the concurrency group of the workflow, by default its branch and file name when cancelInProgress is set
+// without a group. Groups are prefixed with the provider and repository, so workflows of other repositories using the
+// same group name never cancel each other
+func getConcurrencyGroup(scmWorkflowDetails *ScmWorkflowDetails) string {
+	concurrency := scmWorkflowDetails.Workflow.WorkflowYaml.Workflow.Concurrency
+	repository := fmt.Sprintf("%s/%s/%s", scmWorkflowDetails.ScProvider, scmWorkflowDetails.GitOrgProject, scmWorkflowDetails.GitRepository)
+	if concurrency.Group != "" {
+		return repository + "/" + concurrency.Group
+	}
+	if concurrency.CancelInProgress {
+		return fmt.Sprintf("%s/%s/%s", repository, scmWorkflowDetails.Branch, scmWorkflowDetails.Workflow.FileName)
+	}
+	return ""
+}
+
+// Groups are free text, the label holds their hash to fit the label value syntax
+func getConcurrencyGroupLabel(group string) string {
+	hash := sha1.Sum([]byte(group))
+	return hex.EncodeToString(hash[:])
+}
+
+// Time the job was generated, queued jobs being created later. Jobs created without the annotation fall back to their
+// creation timestamp
+func getJobCreatedAt(job *batchv1.Job) time.Time {
+	if createdAt, err := time.Parse(time.RFC3339Nano, job.Annotations["agnops/created-at"]); err == nil {
+		return createdAt
+	}
+	return job.CreationTimestamp.Time
+}
+
+// Deletes the unfinished jobs of the workflow's concurrency group generated before createdAt for another commit, and
+// reports them cancelled. A job generated meanwhile for a newer push is left running
+func cancelSupersededJobs(scmWorkflowDetails *ScmWorkflowDetails, createdAt time.Time) {
+	group := getConcurrencyGroup(scmWorkflowDetails)
+	if group == "" || !scmWorkflowDetails.Workflow.WorkflowYaml.Workflow.Concurrency.CancelInProgress {
+		return
+	}
+
+	if isJobQueueEnabled() {
+		cancelQueuedJobs(group, scmWorkflowDetails.CommitId, createdAt)
+	}
+
+	jobsClient := clientset.BatchV1().Jobs(namespace)
+	jobs, err := jobsClient.List(context.TODO(), metav1.ListOptions{LabelSelector: "agnops=job,agnops/concurrency-group=" + getConcurrencyGroupLabel(group)})
+	if err != nil {
+		failOnError(err, "Failed to list the jobs of concurrency group "+group)
+		return
+	}
+
+	propagationPolicy := metav1.DeletePropagationBackground
+	for i, job := range jobs.Items {
+		if job.Annotations["agnops/commit"] == scmWorkflowDetails.CommitId || !getJobCreatedAt(&job).Before(createdAt) || isJobFinished(getJobState(&job)) {
+			continue
+		}
+
+		log.Printf("Cancelling job %s, superseded by commit %s in concurrency group %s\n", job.Name, scmWorkflowDetails.CommitId, group)
+		err := jobsClient.Delete(context.TODO(), job.Name, metav1.DeleteOptions{PropagationPolicy: &propagationPolicy})
+		if err != nil {
+			failOnError(err, "Failed to cancel the job "+job.Name)
+			continue
+		}
+
+		reason := "superseded by commit " + scmWorkflowDetails.CommitId
+		err = updateRunRecord(job.Name, func(runRecord *RunRecord) {
+			runRecord.Reason = reason
+		})
+		failOnError(err, "Failed to record the cancellation of job "+job.Name)
+
+		// Notified in the background, as the needs handler may in turn create the jobs of dependent workflows
+		go notifyJobState(&jobs.Items[i], JobCancelled)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestCancelSupersededJobsKeepsOtherRepositories(t *testing.T) {
+	previousClientset, previousConfigMapClient := clientset, configMapClient
+	defer func() { clientset, configMapClient = previousClientset, previousConfigMapClient }()
+
+	getDetails := func(repository string, commitId string) *ScmWorkflowDetails {
+		details := &ScmWorkflowDetails{ScProvider: "github", GitOrgProject: "agnops", GitRepository: repository, Branch: "master", CommitId: commitId}
+		details.Workflow.FileName = "deploy.yaml"
+		details.Workflow.WorkflowYaml.Workflow.Concurrency = WorkflowConcurrency{Group: "deploy", CancelInProgress: true}
+		return details
+	}
+	generatedAt := time.Now().UTC().Add(-time.Minute)
+	getJob := func(name string, details *ScmWorkflowDetails) *batchv1.Job {
+		return &batchv1.Job{ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   namespace,
+			Labels:      getJobLabels(details, name),
+			Annotations: map[string]string{"agnops/commit": details.CommitId, "agnops/created-at": generatedAt.Format(time.RFC3339Nano)},
+		}}
+	}
+	fakeClientset := fake.NewSimpleClientset(
+		getJob("deploy-examples", getDetails("examples", "1")),
+		getJob("deploy-job-generator", getDetails("job-generator", "1")),
+	)
+	clientset = fakeClientset
+	configMapClient = fakeClientset.CoreV1().ConfigMaps(namespace)
+
+	cancelSupersededJobs(getDetails("job-generator", "2"), time.Now().UTC())
+
+	jobs, err := fakeClientset.BatchV1().Jobs(namespace).List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, job := range jobs.Items {
+		names = append(names, job.Name)
+	}
+	if len(names) != 1 || names[0] != "deploy-examples" {
+		t.Errorf("got jobs %v, want only deploy-examples left", names)
+	}
+}
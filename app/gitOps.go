@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"gopkg.in/yaml.v3"
 	"io/ioutil"
+	"log"
 	"os"
 	"path"
 	"path/filepath"
@@ -17,72 +18,131 @@ import (
 )
 
 type ScmWorkflowDetails struct {
-	ScProvider      string
-	GitOrgProject   string
-	GitRepository   string
-	OAuthToken      string
-	CloneURL        string
-	Branch          string
-	CommitMsg       string
-	CommitId        string
-	CommitUrl       string
-	Email     	    string
-	Workflow    	Workflow
+	ScProvider    string
+	GitOrgProject string
+	GitRepository string
+	ProjectId     string
+	OAuthToken    string
+	CloneURL      string
+	Branch        string
+	Tag           string
+	Event         string
+	ChangedFiles  []string
+	CommitMsg     string
+	CommitId      string
+	CommitUrl     string
+	Email         string
+	Matrix        map[string]string
+	Attempt       int
+	Workflow      Workflow
 }
+
 // Created with https://yaml.to-go.online/
 // https://raw.githubusercontent.com/agnops/examples/master/.agnops/workflow-with-everything.yaml
 type WorkflowYaml struct {
 	Workflow struct {
-		AutoTrigger  bool `yaml:"autoTrigger"`
+		AutoTrigger  bool                `yaml:"autoTrigger"`
+		Vars         map[string]string   `yaml:"vars"`
+		Matrix       Matrix              `yaml:"matrix"`
+		Needs        []string            `yaml:"needs"`
+		Kubernetes   WorkflowKubernetes  `yaml:"kubernetes"`
+		Concurrency  WorkflowConcurrency `yaml:"concurrency"`
 		GlobalAddOns struct {
 			RAMDisk        string   `yaml:"ramDisk"`
 			RepoName       string   `yaml:"repoName"`
 			DockerFilePath string   `yaml:"dockerFilePath"`
 			DockerCloudOps []string `yaml:"dockerCloudOps"`
 		} `yaml:"globalAddOns"`
-		CloudFilters  []string `yaml:"cloudFilters"`
-		BranchFilters []string `yaml:"branchFilters"`
-		TrackedFiles  []string `yaml:"trackedFiles"`
-		Containers    []struct {
-			Container interface{} `yaml:"container"`
-			Name      string      `yaml:"name"`
-			Image     string      `yaml:"image"`
-			Command   string      `yaml:"command"`
-			AddOns    struct {
-				IsDocker bool `yaml:"isDocker"`
-			} `yaml:"addOns,omitempty"`
-			Kubernetes struct {
-				EnvFrom []struct {
-					SecretRef struct {
-						Name string `yaml:"name"`
-					} `yaml:"secretRef"`
-				} `yaml:"envFrom"`
-				Resources struct {
-					Limits struct {
-						CPU    string `yaml:"cpu"`
-						Memory string `yaml:"memory"`
-					} `yaml:"limits"`
-					Requests struct {
-						CPU    string `yaml:"cpu"`
-						Memory string `yaml:"memory"`
-					} `yaml:"requests"`
-				} `yaml:"resources"`
-			} `yaml:"kubernetes,omitempty"`
-		} `yaml:"containers"`
+		CloudFilters      []string                   `yaml:"cloudFilters"`
+		BranchFilters     []string                   `yaml:"branchFilters"`
+		TrackedFiles      []string                   `yaml:"trackedFiles"`
+		AuthorFilters     []string                   `yaml:"authorFilters"`
+		IgnoreAuthors     []string                   `yaml:"ignoreAuthors"`
+		Services          []WorkflowService          `yaml:"services"`
+		Caches            []WorkflowCache            `yaml:"cache"`
+		DownloadArtifacts []WorkflowArtifactDownload `yaml:"downloadArtifacts"`
+		Containers        []WorkflowContainer        `yaml:"containers"`
 	} `yaml:"workflow"`
 }
 
+type WorkflowKubernetes struct {
+	Timeout            string            `yaml:"timeout"`
+	Retries            *int              `yaml:"retries"`
+	Ttl                string            `yaml:"ttl"`
+	Priority           int               `yaml:"priority"`
+	ImagePullSecrets   []string          `yaml:"imagePullSecrets"`
+	ServiceAccountName string            `yaml:"serviceAccountName"`
+	Security           WorkflowSecurity  `yaml:"security"`
+	NodeSelector       map[string]string `yaml:"nodeSelector"`
+	// Kubernetes pod spec values, converted by getJobPlacement
+	Tolerations interface{} `yaml:"tolerations"`
+	Affinity    interface{} `yaml:"affinity"`
+}
+
+type WorkflowContainer struct {
+	Container  interface{} `yaml:"container"`
+	Name       string      `yaml:"name"`
+	Image      string      `yaml:"image"`
+	PullPolicy string      `yaml:"pullPolicy"`
+	Command    string      `yaml:"command"`
+	AddOns     struct {
+		IsDocker bool   `yaml:"isDocker"`
+		Builder  string `yaml:"builder"`
+	} `yaml:"addOns,omitempty"`
+	Kubernetes struct {
+		EnvFrom []struct {
+			SecretRef struct {
+				Name string `yaml:"name"`
+			} `yaml:"secretRef"`
+		} `yaml:"envFrom"`
+		Resources struct {
+			Limits struct {
+				CPU    string `yaml:"cpu"`
+				Memory string `yaml:"memory"`
+			} `yaml:"limits"`
+			Requests struct {
+				CPU    string `yaml:"cpu"`
+				Memory string `yaml:"memory"`
+			} `yaml:"requests"`
+		} `yaml:"resources"`
+	} `yaml:"kubernetes,omitempty"`
+	DependsOn []string           `yaml:"dependsOn"`
+	Artifacts []WorkflowArtifact `yaml:"artifacts"`
+	Timeout   string             `yaml:"timeout"`
+	Retry     struct {
+		Count       int    `yaml:"count"`
+		Backoff     string `yaml:"backoff"`
+		OnExitCodes []int  `yaml:"onExitCodes"`
+	} `yaml:"retry,omitempty"`
+	When struct {
+		Branches     []string `yaml:"branches"`
+		ChangedFiles []string `yaml:"changedFiles"`
+		Clouds       []string `yaml:"clouds"`
+		Events       []string `yaml:"events"`
+	} `yaml:"when,omitempty"`
+}
+
 type Workflow struct {
-	FileName		string
-	WorkflowYaml	WorkflowYaml
+	FileName          string
+	WorkflowYaml      WorkflowYaml
+	SkippedContainers []string
+	StepNeeds         [][]int
+	JobLimits         JobLimits
+	JobPlacement      JobPlacement
+	PassedSteps       map[string]bool
+	Error             string
 }
 
-func checkModifiedFiles(modifiedFiles[] string, trackedFiles[] string) bool {
+func checkModifiedFiles(modifiedFiles []string, trackedFiles []string) bool {
 
 	if len(trackedFiles) > 0 {
 		for _, md := range modifiedFiles {
 			for _, tf := range trackedFiles {
-				if strings.Contains(md, tf) {
+				if strings.ContainsAny(tf, "*?") {
+					if globToRegexp(tf).MatchString(md) {
+						return true
+					}
+				} else if strings.Contains(md, tf) {
 					return true
 				}
 			}
@@ -93,7 +153,7 @@ func checkModifiedFiles(modifiedFiles[] string, trackedFiles[] string) bool {
 	}
 }
 
-func checkBranchFilters(branchFilters[] string, branch string) bool {
+func checkBranchFilters(branchFilters []string, branch string) bool {
 
 	if len(branchFilters) > 0 {
 		for _, bf := range branchFilters {
@@ -109,10 +169,166 @@ func checkBranchFilters(branchFilters[] string, branch string) bool {
 	}
 }
 
-func checkCloudFilters(cloudFilters[] string) bool {
+func checkCloudFilters(cloudFilters []string) bool {
 	return checkBranchFilters(cloudFilters, cloudName)
 }
 
+// Extra markers skipping CI, comma separated in SKIP_CI_MARKERS
+func getSkipCiMarkers() []string {
+	markers := []string{"[skip ci]", "[ci skip]"}
+	for _, marker := range strings.Split(os.Getenv("SKIP_CI_MARKERS"), ",") {
+		if len(strings.TrimSpace(marker)) > 0 {
+			markers = append(markers, strings.TrimSpace(marker))
+		}
+	}
+	return markers
+}
+
+var skipCiMarkers = getSkipCiMarkers()
+
+// Returns the skip CI marker found in the commit message, or an empty string
+func getSkipCiMarker(commitMsg string) string {
+	for _, marker := range skipCiMarkers {
+		if strings.Contains(strings.ToLower(commitMsg), strings.ToLower(marker)) {
+			return marker
+		}
+	}
+	return ""
+}
+
+func matchAuthor(patterns []string, email string) bool {
+	for _, pattern := range patterns {
+		if globToRegexp(strings.ToLower(pattern)).MatchString(strings.ToLower(email)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns an empty reason when the author email passes authorFilters and ignoreAuthors
+func checkAuthorFilters(authorFilters []string, ignoreAuthors []string, email string) string {
+	if len(authorFilters) > 0 && !matchAuthor(authorFilters, email) {
+		return "author " + email + " does not match authorFilters"
+	}
+	if matchAuthor(ignoreAuthors, email) {
+		return "author " + email + " matches ignoreAuthors"
+	}
+	return ""
+}
+
+// Converts a glob such as docs/** or src/*.go to an anchored regexp, ** matching across directories
+func globToRegexp(pattern string) *regexp.Regexp {
+	var expression strings.Builder
+	expression.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		switch {
+		case strings.HasPrefix(pattern[i:], "**/"):
+			expression.WriteString("(.*/)?")
+			i += 2
+		case strings.HasPrefix(pattern[i:], "**"):
+			expression.WriteString(".*")
+			i++
+		case pattern[i] == '*':
+			expression.WriteString("[^/]*")
+		case pattern[i] == '?':
+			expression.WriteString("[^/]")
+		default:
+			expression.WriteString(regexp.QuoteMeta(string(pattern[i])))
+		}
+	}
+	expression.WriteString("$")
+	return regexp.MustCompile(expression.String())
+}
+
+func checkEventFilters(eventFilters []string, event string) bool {
+	if len(eventFilters) == 0 {
+		return true
+	}
+	for _, ef := range eventFilters {
+		if strings.EqualFold(ef, event) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns an empty reason when the container has to run, otherwise the first unmet condition of its when section
+func checkContainerConditions(container WorkflowContainer, scmWorkflowDetails *ScmWorkflowDetails) string {
+	if !checkBranchFilters(container.When.Branches, scmWorkflowDetails.Branch) {
+		return "branch " + scmWorkflowDetails.Branch + " does not match when.branches"
+	}
+	if !checkModifiedFiles(scmWorkflowDetails.ChangedFiles, container.When.ChangedFiles) {
+		return "no changed file matches when.changedFiles"
+	}
+	if !checkCloudFilters(container.When.Clouds) {
+		return "cloud " + cloudName + " does not match when.clouds"
+	}
+	if !checkEventFilters(container.When.Events, scmWorkflowDetails.Event) {
+		return "event " + scmWorkflowDetails.Event + " does not match when.events"
+	}
+	return ""
+}
+
+// Checks the workflow against the operator policies, before its jobs are created and again before a rerun
+func checkWorkflowPolicies(scmWorkflowDetails *ScmWorkflowDetails) error {
+	if err := checkServices(scmWorkflowDetails.Workflow.WorkflowYaml.Workflow.Services); err != nil {
+		return err
+	}
+	if err := checkCaches(scmWorkflowDetails.Workflow.WorkflowYaml.Workflow.Caches); err != nil {
+		return err
+	}
+	if err := checkArtifacts(scmWorkflowDetails); err != nil {
+		return err
+	}
+	if err := checkImages(scmWorkflowDetails); err != nil {
+		return err
+	}
+	if err := checkSecurity(scmWorkflowDetails); err != nil {
+		return err
+	}
+
+	for _, container := range scmWorkflowDetails.Workflow.WorkflowYaml.Workflow.Containers {
+		if err := checkStepPolicy(container); err != nil {
+			return err
+		}
+		if err := checkBuilder(container); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Keeps the containers whose when conditions are met, records the skipped ones and the steps each container waits for
+func selectWorkflowContainers(scmWorkflowDetails *ScmWorkflowDetails) error {
+	allContainers := scmWorkflowDetails.Workflow.WorkflowYaml.Workflow.Containers
+	dependencies, err := getContainersDependencies(allContainers)
+	if err != nil {
+		return err
+	}
+	if err := checkWorkflowPolicies(scmWorkflowDetails); err != nil {
+		return err
+	}
+
+	var containers []WorkflowContainer
+	var skippedContainers []string
+	skipped := map[string]bool{}
+
+	for _, container := range allContainers {
+		if reason := checkContainerConditions(container, scmWorkflowDetails); reason != "" {
+			log.Printf("Skipping container %s of %s: %s\n", container.Name, scmWorkflowDetails.Workflow.FileName, reason)
+			skippedContainers = append(skippedContainers, container.Name+": "+reason)
+			skipped[container.Name] = true
+			continue
+		}
+		containers = append(containers, container)
+	}
+
+	scmWorkflowDetails.Workflow.WorkflowYaml.Workflow.Containers = containers
+	scmWorkflowDetails.Workflow.SkippedContainers = skippedContainers
+	scmWorkflowDetails.Workflow.StepNeeds = getStepNeeds(containers, dependencies, skipped)
+	return nil
+}
+
 func checkGitWorkflowExistInRepo(clone_url string, git_org_project string, git_repository string, commit string, token string, token_user string, modifiedFiles []string, branch string) ([]Workflow, error) {
 
 	curWd, _ := os.Getwd()
@@ -182,11 +398,11 @@ func checkGitWorkflowExistInRepo(clone_url string, git_org_project string, git_r
 						workflows = append(workflows, Workflow{FileName: yamlFile, WorkflowYaml: workflowYaml})
 					}
 				} else {
-					failOnError(err, "Failed to unmarshal the workflow file: " + yamlFile)
-					workflows = append(workflows, Workflow{FileName: yamlFile, WorkflowYaml: WorkflowYaml{}})
+					failOnError(err, "Failed to unmarshal the workflow file: "+yamlFile)
+					workflows = append(workflows, Workflow{FileName: yamlFile, WorkflowYaml: WorkflowYaml{}, Error: err.Error()})
 				}
 			}
 		}
 	}
 	return workflows, err
-}
\ No newline at end of file
+}
@@ -0,0 +1,55 @@
+package main
+
+import "testing"
+
+func TestCheckBranchFilters(t *testing.T) {
+	tests := []struct {
+		name    string
+		filters []string
+		branch  string
+		want    bool
+	}{
+		{name: "no filter", branch: "master", want: true},
+		{name: "exact name", filters: []string{"master"}, branch: "master", want: true},
+		{name: "other branch", filters: []string{"master"}, branch: "develop", want: false},
+		{name: "second filter", filters: []string{"master", "develop"}, branch: "develop", want: true},
+		{name: "regexp between slashes", filters: []string{"/^release-.*/"}, branch: "release-1.0", want: true},
+		{name: "anchored regexp", filters: []string{"/^release-.*/"}, branch: "hotfix-release-1.0", want: false},
+		{name: "full match", filters: []string{"^main$"}, branch: "main-fix", want: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := checkBranchFilters(test.filters, test.branch); got != test.want {
+				t.Errorf("checkBranchFilters(%q, %q) = %t, want %t", test.filters, test.branch, got, test.want)
+			}
+		})
+	}
+}
+
+func TestCheckModifiedFiles(t *testing.T) {
+	tests := []struct {
+		name          string
+		modifiedFiles []string
+		trackedFiles  []string
+		want          bool
+	}{
+		{name: "no tracked file", modifiedFiles: []string{"README.md"}, want: true},
+		{name: "path prefix", modifiedFiles: []string{"app/main.go"}, trackedFiles: []string{"app/"}, want: true},
+		{name: "untracked change", modifiedFiles: []string{"README.md"}, trackedFiles: []string{"app/"}, want: false},
+		{name: "no change", trackedFiles: []string{"app/"}, want: false},
+		{name: "glob", modifiedFiles: []string{"app/main.go"}, trackedFiles: []string{"app/*.go"}, want: true},
+		{name: "glob within one directory", modifiedFiles: []string{"app/cmd/main.go"}, trackedFiles: []string{"app/*.go"}, want: false},
+		{name: "recursive glob", modifiedFiles: []string{"docs/api/runs.md"}, trackedFiles: []string{"docs/**"}, want: true},
+		{name: "recursive glob at any depth", modifiedFiles: []string{"main.go"}, trackedFiles: []string{"**/*.go"}, want: true},
+		{name: "single character glob", modifiedFiles: []string{"v2.txt"}, trackedFiles: []string{"v?.txt"}, want: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := checkModifiedFiles(test.modifiedFiles, test.trackedFiles); got != test.want {
+				t.Errorf("checkModifiedFiles(%q, %q) = %t, want %t", test.modifiedFiles, test.trackedFiles, got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var githubApiUrl = getGitHubApiUrl()
+
+// GitHub App credentials, used instead of the OAuth token secrets when both are set
+var githubAppId = os.Getenv("GITHUB_APP_ID")
+var githubAppPrivateKeyPath = os.Getenv("GITHUB_APP_PRIVATE_KEY_PATH")
+
+type githubInstallationToken struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+var githubInstallationTokens = map[string]githubInstallationToken{}
+var githubInstallationTokensMutex sync.Mutex
+
+var githubStates = map[string]string{
+	JobQueued:    "pending",
+	JobPending:   "pending",
+	JobRunning:   "pending",
+	JobSucceeded: "success",
+	JobFailed:    "failure",
+	JobCancelled: "error",
+	JobSkipped:   "success",
+}
+
+func getGitHubApiUrl() string {
+	if apiUrl := os.Getenv("GITHUB_API_URL"); apiUrl != "" {
+		return apiUrl
+	}
+	return "https://api.github.com"
+}
+
+func doGitHubRequest(method string, url string, authorization string, body interface{}, result interface{}) error {
+	var content []byte
+	if body != nil {
+		var err error
+		if content, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+
+	request, err := http.NewRequest(method, githubApiUrl+url, bytes.NewReader(content))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Accept", "application/vnd.github.v3+json")
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("Authorization", authorization)
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	responseBody, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+	if response.StatusCode >= 300 {
+		return &scmResponseError{Method: method, Url: url, StatusCode: response.StatusCode, Body: responseBody}
+	}
+	if result != nil {
+		return json.Unmarshal(responseBody, result)
+	}
+	return nil
+}
+
+func getGitHubAppJWT() (string, error) {
+	keyPEM, err := ioutil.ReadFile(githubAppPrivateKeyPath)
+	if err != nil {
+		return "", err
+	}
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return "", errors.New("no PEM data in " + githubAppPrivateKeyPath)
+	}
+	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now().Unix()
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`))
+	claims, _ := json.Marshal(map[string]interface{}{"iat": now - 60, "exp": now + 540, "iss": githubAppId})
+	signingInput := header + "." + base64.RawURLEncoding.EncodeToString(claims)
+
+	hash := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+	if err != nil {
+		return "", err
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// Returns an installation token of the GitHub App for the repository, cached until it is about to expire
+func getGitHubAppToken(org string, repository string) (string, error) {
+	githubInstallationTokensMutex.Lock()
+	defer githubInstallationTokensMutex.Unlock()
+
+	cacheKey := org + "/" + repository
+	if token, ok := githubInstallationTokens[cacheKey]; ok && time.Now().Add(time.Minute).Before(token.ExpiresAt) {
+		return token.Token, nil
+	}
+
+	jwt, err := getGitHubAppJWT()
+	if err != nil {
+		return "", err
+	}
+
+	var installation struct {
+		Id int64 `json:"id"`
+	}
+	if err := doGitHubRequest("GET", "/repos/"+org+"/"+repository+"/installation", "Bearer "+jwt, nil, &installation); err != nil {
+		return "", err
+	}
+
+	var token githubInstallationToken
+	if err := doGitHubRequest("POST", "/app/installations/"+strconv.FormatInt(installation.Id, 10)+"/access_tokens", "Bearer "+jwt, nil, &token); err != nil {
+		return "", err
+	}
+	githubInstallationTokens[cacheKey] = token
+	return token.Token, nil
+}
+
+func getGitHubToken(org string, repository string) (string, error) {
+	if githubAppId != "" && githubAppPrivateKeyPath != "" {
+		return getGitHubAppToken(org, repository)
+	}
+	return GetUserOrOrganizationToken(scmProvider, org)
+}
+
+func postGitHubCommitStatus(status commitStatus) error {
+	token, err := getGitHubToken(status.Org, status.Repository)
+	if err != nil {
+		return err
+	}
+
+	description := status.Description
+	if len(description) > 140 {
+		description = description[:140]
+	}
+
+	return doGitHubRequest("POST", "/repos/"+status.Org+"/"+status.Repository+"/statuses/"+status.CommitId, "token "+token, map[string]string{
+		"state":       githubStates[status.State],
+		"target_url":  status.TargetUrl,
+		"description": description,
+		"context":     status.Context,
+	}, nil)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+)
+
+var gitlabApiUrl = getGitLabApiUrl()
+
+var gitlabStates = map[string]string{
+	JobQueued:    "pending",
+	JobPending:   "pending",
+	JobRunning:   "running",
+	JobSucceeded: "success",
+	JobFailed:    "failed",
+	JobCancelled: "canceled",
+	JobSkipped:   "skipped",
+}
+
+func getGitLabApiUrl() string {
+	if apiUrl := os.Getenv("GITLAB_API_URL"); apiUrl != "" {
+		return apiUrl
+	}
+	return "https://gitlab.com/api/v4"
+}
+
+func doGitLabRequest(method string, url string, token string, body interface{}) error {
+	content, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequest(method, gitlabApiUrl+url, bytes.NewReader(content))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("Authorization", "Bearer "+token)
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode >= 300 {
+		responseBody, _ := ioutil.ReadAll(response.Body)
+		return &scmResponseError{Method: method, Url: url, StatusCode: response.StatusCode, Body: responseBody}
+	}
+	return nil
+}
+
+func postGitLabCommitStatus(status commitStatus) error {
+	token, err := GetUserOrOrganizationToken(scmProvider, status.Org)
+	if err != nil {
+		return err
+	}
+
+	body := map[string]string{
+		"state":       gitlabStates[status.State],
+		"name":        status.Context,
+		"description": status.Description,
+	}
+	if status.TargetUrl != "" {
+		body["target_url"] = status.TargetUrl
+	}
+	return doGitLabRequest("POST", "/projects/"+status.ProjectId+"/statuses/"+status.CommitId, token, body)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	apiv1 "k8s.io/api/core/v1"
+)
+
+// Image of the job-helper-init container cloning the repository. Pin it with a digest, image@sha256:..., to run a
+// known build of the helper
+var jobHelperImage = getEnvString("JOB_HELPER_IMAGE", "agnops/job-helper")
+
+// Pull policy of the step, service and helper images which do not set one. Empty keeps Always for tags and uses
+// IfNotPresent for images pinned with a digest, which can not change
+var defaultImagePullPolicy = getEnvString("IMAGE_PULL_POLICY", "")
+
+// Repositories, as org or org/repo, whose step and service images may be run from the node cache, with the
+// pullPolicy of the workflow or IMAGE_PULL_POLICY. The other workflows only run the images pinned with a digest from
+// the node cache, with IfNotPresent, and always pull the tagged ones, so the registry checks their pull secrets and a
+// workflow can not run a private image another tenant pulled on the node without knowing its digest
+var cachedImageAllowlist = getEnvList("JOB_CACHED_IMAGE_ALLOWLIST")
+
+// Comma separated docker-registry secrets of the job namespace used by every job, workflows may add their own
+var defaultImagePullSecrets = getEnvList("JOB_IMAGE_PULL_SECRETS")
+
+// Docker-registry secrets a workflow may add, as name for every repository, org=name or org/repo=name
+var imagePullSecretAllowlist = getEnvList("JOB_IMAGE_PULL_SECRET_ALLOWLIST")
+
+var secretNameRegexp = regexp.MustCompile(`^[a-z0-9]([a-z0-9.-]{0,251}[a-z0-9])?$`)
+
+func checkImagePullPolicy(pullPolicy string) error {
+	switch apiv1.PullPolicy(pullPolicy) {
+	case "", apiv1.PullAlways, apiv1.PullIfNotPresent, apiv1.PullNever:
+		return nil
+	}
+	return fmt.Errorf("pullPolicy %q must be Always, IfNotPresent or Never", pullPolicy)
+}
+
+// Checks the pull policy of a workflow image. When the repository may not use cached images, only Always is allowed,
+// and IfNotPresent for an image pinned with a digest
+func checkWorkflowImagePullPolicy(image string, pullPolicy string, cachedImages bool) error {
+	if err := checkImagePullPolicy(pullPolicy); err != nil {
+		return err
+	}
+	switch {
+	case pullPolicy == "" || apiv1.PullPolicy(pullPolicy) == apiv1.PullAlways || cachedImages:
+		return nil
+	case apiv1.PullPolicy(pullPolicy) == apiv1.PullIfNotPresent && isImagePinned(image):
+		return nil
+	}
+	return fmt.Errorf("pullPolicy %s needs an image pinned with a digest or the repository to be in JOB_CACHED_IMAGE_ALLOWLIST", pullPolicy)
+}
+
+func checkImages(scmWorkflowDetails *ScmWorkflowDetails) error {
+	cachedImages := isCachedImageAllowed(scmWorkflowDetails)
+	for _, container := range scmWorkflowDetails.Workflow.WorkflowYaml.Workflow.Containers {
+		if err := checkWorkflowImagePullPolicy(container.Image, container.PullPolicy, cachedImages); err != nil {
+			return fmt.Errorf("container %q: %s", container.Name, err)
+		}
+	}
+	for _, service := range scmWorkflowDetails.Workflow.WorkflowYaml.Workflow.Services {
+		if err := checkWorkflowImagePullPolicy(service.Image, service.PullPolicy, cachedImages); err != nil {
+			return fmt.Errorf("service %q: %s", service.Name, err)
+		}
+	}
+	allowedPullSecrets := getRepositoryAllowlist(imagePullSecretAllowlist, scmWorkflowDetails)
+	for _, name := range scmWorkflowDetails.Workflow.WorkflowYaml.Workflow.Kubernetes.ImagePullSecrets {
+		if !secretNameRegexp.MatchString(name) {
+			return fmt.Errorf("kubernetes.imagePullSecrets: invalid secret name %q", name)
+		}
+		if !containsString(allowedPullSecrets, name) && !containsString(defaultImagePullSecrets, name) {
+			return fmt.Errorf("kubernetes.imagePullSecrets: secret %s is not allowed", name)
+		}
+	}
+	return nil
+}
+
+func isCachedImageAllowed(scmWorkflowDetails *ScmWorkflowDetails) bool {
+	for _, scope := range cachedImageAllowlist {
+		if isWorkflowRepository(scope, scmWorkflowDetails) {
+			return true
+		}
+	}
+	return false
+}
+
+func isImagePinned(image string) bool {
+	return strings.Contains(image, "@sha256:")
+}
+
+// Returns the pull policy of image, the one of the workflow first, then IMAGE_PULL_POLICY
+func getImagePullPolicy(image string, pullPolicy string) apiv1.PullPolicy {
+	if pullPolicy == "" {
+		pullPolicy = defaultImagePullPolicy
+	}
+	if pullPolicy != "" {
+		return apiv1.PullPolicy(pullPolicy)
+	}
+	if isImagePinned(image) {
+		return apiv1.PullIfNotPresent
+	}
+	return apiv1.PullAlways
+}
+
+// Returns the pull policy of a step or service image. Unless the repository may use cached images, it is Always but
+// for the images pinned with a digest pulled IfNotPresent
+func getWorkflowImagePullPolicy(image string, pullPolicy string, cachedImages bool) apiv1.PullPolicy {
+	imagePullPolicy := getImagePullPolicy(image, pullPolicy)
+	if cachedImages || (imagePullPolicy == apiv1.PullIfNotPresent && isImagePinned(image)) {
+		return imagePullPolicy
+	}
+	return apiv1.PullAlways
+}
+
+// Helper and builder containers follow IMAGE_PULL_POLICY
+func setDefaultImagePullPolicies(containers []apiv1.Container) {
+	for i := range containers {
+		if containers[i].ImagePullPolicy == "" {
+			containers[i].ImagePullPolicy = getImagePullPolicy(containers[i].Image, "")
+		}
+	}
+}
+
+// Returns the pull secrets of the installation followed by the ones of the workflow, without duplicates
+func getImagePullSecrets(workflowKubernetes WorkflowKubernetes) []apiv1.LocalObjectReference {
+	var pullSecrets []apiv1.LocalObjectReference
+	added := map[string]bool{}
+	for _, name := range append(append([]string{}, defaultImagePullSecrets...), workflowKubernetes.ImagePullSecrets...) {
+		if !added[name] {
+			added[name] = true
+			pullSecrets = append(pullSecrets, apiv1.LocalObjectReference{Name: name})
+		}
+	}
+	return pullSecrets
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	apiv1 "k8s.io/api/core/v1"
+)
+
+func TestCheckImages(t *testing.T) {
+	previousCached, previousPullSecrets, previousDefaultPullSecrets := cachedImageAllowlist, imagePullSecretAllowlist, defaultImagePullSecrets
+	defer func() {
+		cachedImageAllowlist, imagePullSecretAllowlist, defaultImagePullSecrets = previousCached, previousPullSecrets, previousDefaultPullSecrets
+	}()
+	cachedImageAllowlist = []string{"agnops/job-generator"}
+	imagePullSecretAllowlist = []string{"public-mirror", "agnops=agnops-registry", "agnops/job-generator=deploy-registry"}
+	defaultImagePullSecrets = []string{"installation-registry"}
+
+	tests := []struct {
+		name        string
+		repository  string
+		image       string
+		pullPolicy  string
+		pullSecrets []string
+		wantErr     string
+	}{
+		{name: "always pulled", repository: "examples", pullPolicy: "Always"},
+		{name: "cached image of an allowed repository", repository: "job-generator", pullPolicy: "IfNotPresent"},
+		{name: "cached image of another repository", repository: "examples", pullPolicy: "Never", wantErr: "JOB_CACHED_IMAGE_ALLOWLIST"},
+		{name: "cached tag of another repository", repository: "examples", pullPolicy: "IfNotPresent", wantErr: "JOB_CACHED_IMAGE_ALLOWLIST"},
+		{name: "cached digest of another repository", repository: "examples", image: "golang@sha256:0123456789abcdef", pullPolicy: "IfNotPresent"},
+		{name: "invalid pull policy", repository: "job-generator", pullPolicy: "Sometimes", wantErr: "must be Always"},
+		{name: "pull secrets of the repository", repository: "job-generator", pullSecrets: []string{"public-mirror", "agnops-registry", "deploy-registry", "installation-registry"}},
+		{name: "pull secret of another repository", repository: "examples", pullSecrets: []string{"deploy-registry"}, wantErr: "secret deploy-registry is not allowed"},
+		{name: "pull secret not allowed", repository: "job-generator", pullSecrets: []string{"agnops-github-token"}, wantErr: "is not allowed"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			details := &ScmWorkflowDetails{GitOrgProject: "AgnOps", GitRepository: test.repository}
+			image := test.image
+			if image == "" {
+				image = "golang:1.14"
+			}
+			details.Workflow.WorkflowYaml.Workflow.Containers = []WorkflowContainer{{Name: "build", Image: image, PullPolicy: test.pullPolicy}}
+			details.Workflow.WorkflowYaml.Workflow.Kubernetes.ImagePullSecrets = test.pullSecrets
+			err := checkImages(details)
+			if test.wantErr == "" && err != nil {
+				t.Fatalf("unexpected error %s", err)
+			}
+			if test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)) {
+				t.Fatalf("got error %v, want %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestGetWorkflowImagePullPolicy(t *testing.T) {
+	previousPullPolicy := defaultImagePullPolicy
+	defer func() { defaultImagePullPolicy = previousPullPolicy }()
+	defaultImagePullPolicy = ""
+
+	pinned := "golang@sha256:0123456789abcdef"
+	tests := []struct {
+		image        string
+		pullPolicy   string
+		cachedImages bool
+		want         apiv1.PullPolicy
+	}{
+		{image: pinned, cachedImages: false, want: apiv1.PullIfNotPresent},
+		{image: pinned, pullPolicy: "Never", cachedImages: false, want: apiv1.PullAlways},
+		{image: "golang:1.14", pullPolicy: "IfNotPresent", cachedImages: false, want: apiv1.PullAlways},
+		{image: pinned, cachedImages: true, want: apiv1.PullIfNotPresent},
+		{image: "golang:1.14", cachedImages: true, want: apiv1.PullAlways},
+		{image: "golang:1.14", pullPolicy: "Never", cachedImages: true, want: apiv1.PullNever},
+	}
+	for _, test := range tests {
+		if got := getWorkflowImagePullPolicy(test.image, test.pullPolicy, test.cachedImages); got != test.want {
+			t.Errorf("getWorkflowImagePullPolicy(%q, %q, %t) = %s, want %s", test.image, test.pullPolicy, test.cachedImages, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+
+	apiv1 "k8s.io/api/core/v1"
+)
+
+// Matches ${{ reference }} expressions inside workflow fields
+var expressionRegexp = regexp.MustCompile(`\$\{\{\s*([^}]*?)\s*\}\}`)
+
+// References controlled by whoever pushes a commit. In the fields run by a shell they are replaced by their quoted
+// environment variable, which the shell expands without parsing its value as code
+var untrustedReferences = map[string]string{
+	"commit.message":      "AGNOPS_COMMIT_MESSAGE",
+	"commit.author_email": "AGNOPS_COMMIT_AUTHOR_EMAIL",
+	"branch":              "AGNOPS_BRANCH",
+	"tag":                 "AGNOPS_TAG",
+}
+
+// Fields holding shell code, the last element of the field path without its index
+var shellFields = map[string]bool{"command": true, "args": true, "ready": true}
+
+type interpolationContext struct {
+	values map[string]string
+	// Values of the references in the shell fields
+	shellValues map[string]string
+}
+
+func getInterpolationContext(scmWorkflowDetails *ScmWorkflowDetails) interpolationContext {
+	values := map[string]string{
+		"commit.sha":          scmWorkflowDetails.CommitId,
+		"commit.short_sha":    getShortCommitId(scmWorkflowDetails.CommitId),
+		"commit.message":      scmWorkflowDetails.CommitMsg,
+		"commit.url":          scmWorkflowDetails.CommitUrl,
+		"commit.author_email": scmWorkflowDetails.Email,
+		"branch":              scmWorkflowDetails.Branch,
+		"tag":                 scmWorkflowDetails.Tag,
+		"provider":            scmWorkflowDetails.ScProvider,
+		"org":                 scmWorkflowDetails.GitOrgProject,
+		"repo":                scmWorkflowDetails.GitRepository,
+		"workflow":            scmWorkflowDetails.Workflow.FileName,
+	}
+	for key, value := range scmWorkflowDetails.Matrix {
+		values["matrix."+key] = value
+	}
+	shellValues := map[string]string{}
+	for reference, value := range values {
+		shellValues[reference] = value
+	}
+	for reference, envName := range untrustedReferences {
+		shellValues[reference] = `"$` + envName + `"`
+	}
+	return interpolationContext{values: values, shellValues: shellValues}
+}
+
+// Returns the environment variables exposing the untrusted references to the steps and services
+func getUntrustedReferenceEnvs(scmWorkflowDetails *ScmWorkflowDetails) []apiv1.EnvVar {
+	values := getInterpolationContext(scmWorkflowDetails).values
+	var envs []apiv1.EnvVar
+	for _, reference := range getSortedKeys(untrustedReferences) {
+		envs = append(envs, apiv1.EnvVar{Name: untrustedReferences[reference], Value: values[reference]})
+	}
+	return envs
+}
+
+func isShellField(fieldPath string) bool {
+	field := fieldPath[strings.LastIndex(fieldPath, ".")+1:]
+	if index := strings.Index(field, "["); index >= 0 {
+		field = field[:index]
+	}
+	return shellFields[field]
+}
+
+// Returns value with its expressions resolved, with their shell values in a shell field
+func interpolateString(value string, context interpolationContext, shell bool) (string, error) {
+	values := context.values
+	if shell {
+		values = context.shellValues
+	}
+	var err error
+	result := expressionRegexp.ReplaceAllStringFunc(value, func(expression string) string {
+		reference := expressionRegexp.FindStringSubmatch(expression)[1]
+		resolved, ok := values[reference]
+		if !ok && err == nil {
+			err = fmt.Errorf("unknown reference %q", reference)
+		}
+		return resolved
+	})
+	return result, err
+}
+
+// Builds an interpolated copy of value, so slices and maps of the source workflow are never modified
+func interpolateValue(value reflect.Value, context interpolationContext, fieldPath string) (reflect.Value, error) {
+	switch value.Kind() {
+	case reflect.String:
+		interpolated, err := interpolateString(value.String(), context, isShellField(fieldPath))
+		if err != nil {
+			return value, fmt.Errorf("%s: %s", fieldPath, err)
+		}
+		result := reflect.New(value.Type()).Elem()
+		result.SetString(interpolated)
+		return result, nil
+
+	case reflect.Struct:
+		result := reflect.New(value.Type()).Elem()
+		for i := 0; i < value.NumField(); i++ {
+			field := value.Type().Field(i)
+			if !result.Field(i).CanSet() {
+				continue
+			}
+			name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+			if name == "" {
+				name = field.Name
+			}
+			interpolated, err := interpolateValue(value.Field(i), context, strings.TrimPrefix(fieldPath+"."+name, "."))
+			if err != nil {
+				return value, err
+			}
+			result.Field(i).Set(interpolated)
+		}
+		return result, nil
+
+	case reflect.Slice:
+		if value.IsNil() {
+			return value, nil
+		}
+		result := reflect.MakeSlice(value.Type(), value.Len(), value.Len())
+		for i := 0; i < value.Len(); i++ {
+			interpolated, err := interpolateValue(value.Index(i), context, fmt.Sprintf("%s[%d]", fieldPath, i))
+			if err != nil {
+				return value, err
+			}
+			result.Index(i).Set(interpolated)
+		}
+		return result, nil
+
+	case reflect.Map:
+		if value.IsNil() {
+			return value, nil
+		}
+		result := reflect.MakeMapWithSize(value.Type(), value.Len())
+		iter := value.MapRange()
+		for iter.Next() {
+			interpolated, err := interpolateValue(iter.Value(), context, fmt.Sprintf("%s.%v", fieldPath, iter.Key().Interface()))
+			if err != nil {
+				return value, err
+			}
+			result.SetMapIndex(iter.Key(), interpolated)
+		}
+		return result, nil
+
+	case reflect.Interface, reflect.Ptr:
+		if value.IsNil() {
+			return value, nil
+		}
+		interpolated, err := interpolateValue(value.Elem(), context, fieldPath)
+		if err != nil {
+			return value, err
+		}
+		if value.Kind() == reflect.Ptr {
+			result := reflect.New(value.Type().Elem())
+			result.Elem().Set(interpolated)
+			return result, nil
+		}
+		result := reflect.New(value.Type()).Elem()
+		result.Set(interpolated)
+		return result, nil
+	}
+
+	return value, nil
+}
+
+// Resolves every ${{ }} expression of the workflow. User defined vars may only refer to the built-in references, in
+// the shell fields the vars referring to an untrusted reference expand its environment variable as well
+func interpolateWorkflow(scmWorkflowDetails *ScmWorkflowDetails) error {
+	context := getInterpolationContext(scmWorkflowDetails)
+
+	vars := scmWorkflowDetails.Workflow.WorkflowYaml.Workflow.Vars
+	resolvedVars := map[string]string{}
+	shellVars := map[string]string{}
+	for _, name := range getSortedKeys(vars) {
+		resolved, err := interpolateString(vars[name], context, false)
+		if err != nil {
+			return fmt.Errorf("workflow.vars.%s: %s", name, err)
+		}
+		resolvedVars[name] = resolved
+		shellVars[name], _ = interpolateString(vars[name], context, true)
+	}
+	for name, value := range resolvedVars {
+		context.values["vars."+name] = value
+		context.shellValues["vars."+name] = shellVars[name]
+	}
+
+	interpolated, err := interpolateValue(reflect.ValueOf(scmWorkflowDetails.Workflow.WorkflowYaml), context, "")
+	if err != nil {
+		return err
+	}
+	workflowYaml := interpolated.Interface().(WorkflowYaml)
+	workflowYaml.Workflow.Vars = resolvedVars
+	scmWorkflowDetails.Workflow.WorkflowYaml = workflowYaml
+	return nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func getInterpolationTestDetails() *ScmWorkflowDetails {
+	return &ScmWorkflowDetails{
+		ScProvider:    "GitHub",
+		GitOrgProject: "agnops",
+		GitRepository: "job-generator",
+		Branch:        "feature/$(id)",
+		CommitId:      "0123456789abcdef",
+		CommitMsg:     "fix `rm -rf /`",
+		Email:         "dev@example.com",
+		Matrix:        map[string]string{"go": "1.14"},
+		Workflow:      Workflow{FileName: "build.yaml"},
+	}
+}
+
+func TestInterpolateString(t *testing.T) {
+	context := getInterpolationContext(getInterpolationTestDetails())
+
+	tests := []struct {
+		name    string
+		value   string
+		shell   bool
+		want    string
+		wantErr string
+	}{
+		{name: "no expression", value: "go test ./...", shell: true, want: "go test ./..."},
+		{name: "trusted references", value: "${{ org }}/${{repo}}@${{ commit.short_sha }}", shell: true, want: "agnops/job-generator@0123456"},
+		{name: "matrix value", value: "golang:${{ matrix.go }}", want: "golang:1.14"},
+		{name: "unknown reference", value: "${{ commit.tree }}", wantErr: "unknown reference"},
+		{name: "untrusted outside a shell", value: "${{ branch }}", want: "feature/$(id)"},
+		{name: "untrusted branch in a shell", value: "echo ${{ branch }}", shell: true, want: `echo "$AGNOPS_BRANCH"`},
+		{name: "untrusted message in a shell", value: "echo ${{ commit.message }}", shell: true, want: `echo "$AGNOPS_COMMIT_MESSAGE"`},
+		{name: "untrusted author in a shell", value: "echo ${{ commit.author_email }}", shell: true, want: `echo "$AGNOPS_COMMIT_AUTHOR_EMAIL"`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result, err := interpolateString(test.value, context, test.shell)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("expected an error containing %q, got %v", test.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if result != test.want {
+				t.Errorf("got %q, want %q", result, test.want)
+			}
+		})
+	}
+}
+
+func TestInterpolateWorkflow(t *testing.T) {
+	tests := []struct {
+		name    string
+		vars    map[string]string
+		command string
+		image   string
+		want    string
+		wantErr string
+	}{
+		{name: "var in a command", vars: map[string]string{"tag": "${{ commit.short_sha }}"}, command: "echo ${{ vars.tag }}", want: "echo 0123456"},
+		{name: "untrusted var in an image", vars: map[string]string{"ref": "${{ branch }}"}, image: "app:${{ vars.ref }}"},
+		{name: "untrusted var in a command", vars: map[string]string{"ref": "v-${{ branch }}"}, command: "echo ${{ vars.ref }}", want: `echo v-"$AGNOPS_BRANCH"`},
+		{name: "var referring to a var", vars: map[string]string{"a": "x", "b": "${{ vars.a }}"}, wantErr: "workflow.vars.b"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			details := getInterpolationTestDetails()
+			workflow := &details.Workflow.WorkflowYaml.Workflow
+			workflow.Vars = test.vars
+			workflow.Containers = []WorkflowContainer{{Name: "build", Image: test.image, Command: test.command}}
+			source := workflow.Containers
+
+			err := interpolateWorkflow(details)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("expected an error containing %q, got %v", test.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if command := details.Workflow.WorkflowYaml.Workflow.Containers[0].Command; command != test.want {
+				t.Errorf("got command %q, want %q", command, test.want)
+			}
+			if source[0].Command != test.command {
+				t.Errorf("the source workflow was modified: %q", source[0].Command)
+			}
+		})
+	}
+}
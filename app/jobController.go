@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+const (
+	JobQueued    = "queued"
+	JobPending   = "pending"
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+	JobCancelled = "cancelled"
+	// Every container of the workflow was skipped by its when conditions, no job was created
+	JobSkipped = "skipped"
+
+	ContainerSkipped = "skipped"
+)
+
+type jobStateHandler func(job *batchv1.Job, state string)
+
+var jobStateHandlers []jobStateHandler
+
+// Last state reported per job, only accessed by the watchJobs goroutine
+var jobStates = map[types.UID]string{}
+
+// Registers a handler called by watchJobs each time a generated job changes state
+func onJobStateChange(handler jobStateHandler) {
+	jobStateHandlers = append(jobStateHandlers, handler)
+}
+
+func getJobState(job *batchv1.Job) string {
+	for _, condition := range job.Status.Conditions {
+		if condition.Status != apiv1.ConditionTrue {
+			continue
+		}
+		switch condition.Type {
+		case batchv1.JobComplete:
+			return JobSucceeded
+		case batchv1.JobFailed:
+			return JobFailed
+		}
+	}
+	if job.Status.Active > 0 {
+		return JobRunning
+	}
+	return JobPending
+}
+
+type ContainerRun struct {
+	Name     string `json:"name"`
+	Status   string `json:"status"`
+	ExitCode *int32 `json:"exitCode,omitempty"`
+	Attempts int    `json:"attempts,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+func getLatestJobPod(job *batchv1.Job) *apiv1.Pod {
+	pods, err := clientset.CoreV1().Pods(job.Namespace).List(context.TODO(), metav1.ListOptions{LabelSelector: "job-name=" + job.Name})
+	if err != nil {
+		failOnError(err, "Failed to list the pods of job "+job.Name)
+		return nil
+	}
+
+	var latestPod *apiv1.Pod
+	for i, pod := range pods.Items {
+		if latestPod == nil || latestPod.CreationTimestamp.Before(&pod.CreationTimestamp) {
+			latestPod = &pods.Items[i]
+		}
+	}
+	return latestPod
+}
+
+func getContainerRun(containerStatus apiv1.ContainerStatus) ContainerRun {
+	containerRun := ContainerRun{Name: containerStatus.Name, Status: JobPending}
+
+	switch {
+	case containerStatus.State.Terminated != nil:
+		terminated := containerStatus.State.Terminated
+		exitCode := terminated.ExitCode
+		containerRun.ExitCode = &exitCode
+		containerRun.Reason = terminated.Reason
+		containerRun.Attempts = getStepAttempts(terminated.Message)
+		switch {
+		case strings.TrimSpace(terminated.Message) == skippedStepMessage:
+			containerRun.Status = ContainerSkipped
+		case exitCode == 0:
+			containerRun.Status = JobSucceeded
+		default:
+			containerRun.Status = JobFailed
+		}
+	case containerStatus.State.Running != nil:
+		containerRun.Status = JobRunning
+	case containerStatus.State.Waiting != nil:
+		containerRun.Reason = containerStatus.State.Waiting.Reason
+	}
+	return containerRun
+}
+
+// Returns the state of the init and workflow containers of the latest pod of the job
+func getJobContainerRuns(job *batchv1.Job) []ContainerRun {
+	pod := getLatestJobPod(job)
+	if pod == nil {
+		return nil
+	}
+
+	var containerRuns []ContainerRun
+	for _, containerStatus := range append(pod.Status.InitContainerStatuses, pod.Status.ContainerStatuses...) {
+		containerRuns = append(containerRuns, getContainerRun(containerStatus))
+	}
+	return containerRuns
+}
+
+// Returns the first container of the job which failed on its own, not because a step it needs failed
+func getFailedContainer(job *batchv1.Job) string {
+	for _, containerRun := range getJobContainerRuns(job) {
+		if containerRun.Status == JobFailed {
+			return containerRun.Name
+		}
+	}
+	return ""
+}
+
+func isJobFinished(state string) bool {
+	return state == JobSucceeded || state == JobFailed || state == JobCancelled || state == JobSkipped
+}
+
+func notifyJobState(job *batchv1.Job, state string) {
+	for _, handler := range jobStateHandlers {
+		handler(job, state)
+	}
+}
+
+func watchJobs() {
+	for {
+		watcher, err := clientset.BatchV1().Jobs(namespace).Watch(context.TODO(), metav1.ListOptions{LabelSelector: "agnops=job"})
+		if err != nil {
+			failOnError(err, "Failed to watch jobs")
+			time.Sleep(5 * time.Second)
+			continue
+		}
+
+		for event := range watcher.ResultChan() {
+			job, ok := event.Object.(*batchv1.Job)
+			if !ok {
+				continue
+			}
+			if event.Type == watch.Deleted {
+				delete(jobStates, job.UID)
+				continue
+			}
+
+			state := getJobState(job)
+			if jobStates[job.UID] == state {
+				continue
+			}
+			jobStates[job.UID] = state
+			log.Printf("Job %s is %s\n", job.Name, state)
+
+			notifyJobState(job, state)
+		}
+		log.Println("Jobs watch closed, restarting it")
+	}
+}
+
+// Waiting reasons of a container which will not start without a change to the workflow or the cluster
+var fatalWaitingReasons = map[string]bool{
+	"InvalidImageName":           true,
+	"ErrImageNeverPull":          true,
+	"CreateContainerConfigError": true,
+	"CreateContainerError":       true,
+}
+
+// Waiting reasons of a container failing to pull its image, often transient. They are fatal once they lasted
+// JOB_IMAGE_PULL_TIMEOUT
+var imagePullWaitingReasons = map[string]bool{
+	"ErrImagePull":     true,
+	"ImagePullBackOff": true,
+}
+var imagePullTimeout = getEnvDuration("JOB_IMAGE_PULL_TIMEOUT", 5*time.Minute)
+
+// Pods whose job was failed by watchJobPods, and when their containers started failing to pull their image, only
+// accessed by its goroutine
+var failedJobPods = map[types.UID]bool{}
+var imagePullFailures = map[types.UID]map[string]time.Time{}
+
+// Tells whether the container waits for a reason which will not resolve itself, a failing image pull only once it
+// lasted imagePullTimeout
+func isContainerStuck(podUID types.UID, containerStatus apiv1.ContainerStatus, now time.Time) bool {
+	waiting := containerStatus.State.Waiting
+	if waiting == nil || !imagePullWaitingReasons[waiting.Reason] {
+		if failures, ok := imagePullFailures[podUID]; ok {
+			delete(failures, containerStatus.Name)
+		}
+		return waiting != nil && fatalWaitingReasons[waiting.Reason]
+	}
+
+	if imagePullFailures[podUID] == nil {
+		imagePullFailures[podUID] = map[string]time.Time{}
+	}
+	since, ok := imagePullFailures[podUID][containerStatus.Name]
+	if !ok {
+		imagePullFailures[podUID][containerStatus.Name] = now
+		return false
+	}
+	return now.Sub(since) >= imagePullTimeout
+}
+
+// Fails the job of a pod with a container which can not start. The steps waiting for it would otherwise wait until
+// the job deadline, the pod staying pending
+func failJobOfStuckPod(pod *apiv1.Pod) {
+	if failedJobPods[pod.UID] {
+		return
+	}
+	now := time.Now()
+	for _, containerStatus := range append(pod.Status.InitContainerStatuses, pod.Status.ContainerStatuses...) {
+		if !isContainerStuck(pod.UID, containerStatus, now) {
+			continue
+		}
+		waiting := containerStatus.State.Waiting
+
+		jobName := pod.Labels["job-name"]
+		reason := "container " + containerStatus.Name + " can not start: " + waiting.Reason
+		if waiting.Message != "" {
+			reason += ", " + waiting.Message
+		}
+		log.Printf("Failing job %s, %s\n", jobName, reason)
+		failedJobPods[pod.UID] = true
+
+		// The job controller fails a job past its deadline and terminates its pods, so the steps record their outcome
+		patch := []byte(`{"spec":{"activeDeadlineSeconds":1}}`)
+		_, err := clientset.BatchV1().Jobs(namespace).Patch(context.TODO(), jobName, types.MergePatchType, patch, metav1.PatchOptions{})
+		failOnError(err, "Failed to fail the job "+jobName)
+		err = updateRunRecord(jobName, func(runRecord *RunRecord) {
+			runRecord.Reason = reason
+		})
+		failOnError(err, "Failed to record the failure reason of job "+jobName)
+		return
+	}
+}
+
+func watchJobPods() {
+	for {
+		watcher, err := clientset.CoreV1().Pods(namespace).Watch(context.TODO(), metav1.ListOptions{LabelSelector: "agnops=job"})
+		if err != nil {
+			failOnError(err, "Failed to watch the job pods")
+			time.Sleep(5 * time.Second)
+			continue
+		}
+
+		for event := range watcher.ResultChan() {
+			pod, ok := event.Object.(*apiv1.Pod)
+			if !ok {
+				continue
+			}
+			if event.Type == watch.Deleted {
+				delete(failedJobPods, pod.UID)
+				delete(imagePullFailures, pod.UID)
+				continue
+			}
+			failJobOfStuckPod(pod)
+			archivePodLogs(pod)
+		}
+		log.Println("Job pods watch closed, restarting it")
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestIsContainerStuck(t *testing.T) {
+	defer func() { imagePullFailures = map[types.UID]map[string]time.Time{} }()
+
+	waiting := func(reason string) apiv1.ContainerStatus {
+		return apiv1.ContainerStatus{Name: "0-build", State: apiv1.ContainerState{Waiting: &apiv1.ContainerStateWaiting{Reason: reason}}}
+	}
+	start := time.Date(2020, 7, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name            string
+		containerStatus apiv1.ContainerStatus
+		at              time.Duration
+		want            bool
+	}{
+		{name: "invalid image name", containerStatus: waiting("InvalidImageName"), want: true},
+		{name: "first pull failure", containerStatus: waiting("ErrImagePull")},
+		{name: "pull backing off", containerStatus: waiting("ImagePullBackOff"), at: imagePullTimeout - time.Second},
+		{name: "pull failing past the timeout", containerStatus: waiting("ErrImagePull"), at: imagePullTimeout, want: true},
+		{name: "image pulled", containerStatus: waiting("ContainerCreating"), at: imagePullTimeout},
+		{name: "pull failing again", containerStatus: waiting("ImagePullBackOff"), at: 2 * imagePullTimeout},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := isContainerStuck("pod", test.containerStatus, start.Add(test.at)); got != test.want {
+				t.Fatalf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Operator defaults and maximums of the workflow kubernetes section
+var defaultJobTimeout = getEnvDuration("JOB_DEFAULT_TIMEOUT", time.Hour)
+var maxJobTimeout = getEnvDuration("JOB_MAX_TIMEOUT", 6*time.Hour)
+var defaultJobRetries = getEnvInt("JOB_DEFAULT_RETRIES", 0)
+var maxJobRetries = getEnvInt("JOB_MAX_RETRIES", 3)
+var defaultJobTtl = getEnvDuration("JOB_DEFAULT_TTL", 20*time.Second)
+var maxJobTtl = getEnvDuration("JOB_MAX_TTL", 24*time.Hour)
+
+type JobLimits struct {
+	ActiveDeadlineSeconds   int64
+	BackoffLimit            int32
+	TTLSecondsAfterFinished int32
+}
+
+func getWorkflowDuration(name string, value string, defaultValue time.Duration, maxValue time.Duration) (time.Duration, error) {
+	if value == "" {
+		if defaultValue > maxValue {
+			return maxValue, nil
+		}
+		return defaultValue, nil
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("workflow.kubernetes.%s: %s", name, err)
+	}
+	// Set in whole seconds on the job
+	if duration < time.Second {
+		return 0, fmt.Errorf("workflow.kubernetes.%s must be at least 1s", name)
+	}
+	if duration > maxValue {
+		return 0, fmt.Errorf("workflow.kubernetes.%s %s exceeds the maximum of %s", name, duration, maxValue)
+	}
+	return duration, nil
+}
+
+// Resolves the timeout, retries and ttl of the workflow against the operator defaults and maximums
+func getJobLimits(workflowKubernetes WorkflowKubernetes) (JobLimits, error) {
+	timeout, err := getWorkflowDuration("timeout", workflowKubernetes.Timeout, defaultJobTimeout, maxJobTimeout)
+	if err != nil {
+		return JobLimits{}, err
+	}
+	ttl, err := getWorkflowDuration("ttl", workflowKubernetes.Ttl, defaultJobTtl, maxJobTtl)
+	if err != nil {
+		return JobLimits{}, err
+	}
+
+	retries := defaultJobRetries
+	if retries > maxJobRetries {
+		retries = maxJobRetries
+	}
+	if workflowKubernetes.Retries != nil {
+		retries = *workflowKubernetes.Retries
+		if retries < 0 || retries > maxJobRetries {
+			return JobLimits{}, fmt.Errorf("workflow.kubernetes.retries must be between 0 and %d", maxJobRetries)
+		}
+	}
+
+	return JobLimits{
+		ActiveDeadlineSeconds:   int64(timeout.Seconds()),
+		BackoffLimit:            int32(retries),
+		TTLSecondsAfterFinished: int32(ttl.Seconds()),
+	}, nil
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGetWorkflowDuration(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    time.Duration
+		wantErr bool
+	}{
+		{name: "default", want: time.Hour},
+		{name: "workflow value", value: "90s", want: 90 * time.Second},
+		{name: "smallest value", value: "1s", want: time.Second},
+		{name: "sub-second value", value: "500ms", wantErr: true},
+		{name: "zero", value: "0s", wantErr: true},
+		{name: "above the maximum", value: "7h", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			duration, err := getWorkflowDuration("timeout", test.value, time.Hour, 6*time.Hour)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("got error %v, want an error: %v", err, test.wantErr)
+			}
+			if !test.wantErr && duration != test.want {
+				t.Fatalf("got %s, want %s", duration, test.want)
+			}
+		})
+	}
+}
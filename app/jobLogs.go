@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"io"
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const maskedValue = "***"
+
+// Pods whose logs are being or were archived, by the time their archiving started. Each pod of a job retried by
+// its backoffLimit is archived
+var archivedPods = map[types.UID]time.Time{}
+var archivedPodsMutex sync.Mutex
+
+// Secret values shorter than this are only masked as whole words, as "true" or "1" inside other words would mask
+// most of the output
+const shortSecretLength = 4
+
+type secretsMasker struct {
+	replacer    *strings.Replacer
+	shortValues *regexp.Regexp
+}
+
+func (masker *secretsMasker) Replace(line string) string {
+	line = masker.replacer.Replace(line)
+	if masker.shortValues != nil {
+		// Run twice, as a match consumes the separator an adjacent occurrence starts with
+		for i := 0; i < 2; i++ {
+			line = masker.shortValues.ReplaceAllString(line, "${1}"+maskedValue+"${3}")
+		}
+	}
+	return line
+}
+
+// Returns a masker of the OAuth token and the values of the secrets the pod's containers refer to
+func getPodSecretsMasker(podSpec apiv1.PodSpec) *secretsMasker {
+	values := map[string]bool{}
+
+	for _, container := range append(podSpec.InitContainers, podSpec.Containers...) {
+		for _, env := range container.Env {
+			if env.Name == "OAUTH_TOKEN" {
+				values[env.Value] = true
+			}
+		}
+		for _, envFrom := range container.EnvFrom {
+			if envFrom.SecretRef == nil {
+				continue
+			}
+			secret, err := secretsClient.Get(context.TODO(), envFrom.SecretRef.Name, metav1.GetOptions{})
+			if err != nil {
+				failOnError(err, "Failed to read the secret "+envFrom.SecretRef.Name)
+				continue
+			}
+			for _, value := range secret.Data {
+				values[string(value)] = true
+			}
+		}
+	}
+
+	var secretValues, shortValues []string
+	for value := range values {
+		switch {
+		case len(value) >= shortSecretLength:
+			secretValues = append(secretValues, value)
+		case len(value) > 0:
+			shortValues = append(shortValues, regexp.QuoteMeta(value))
+		}
+	}
+	sort.Slice(secretValues, func(i, j int) bool {
+		return len(secretValues[i]) > len(secretValues[j])
+	})
+
+	var replacements []string
+	for _, value := range secretValues {
+		replacements = append(replacements, value, maskedValue)
+	}
+	masker := &secretsMasker{replacer: strings.NewReplacer(replacements...)}
+	if len(shortValues) > 0 {
+		sort.Strings(shortValues)
+		masker.shortValues = regexp.MustCompile(`(^|[^A-Za-z0-9_])(` + strings.Join(shortValues, "|") + `)($|[^A-Za-z0-9_])`)
+	}
+	return masker
+}
+
+func archiveContainerLogs(runId string, podName string, containerName string, logName string, masker *secretsMasker) {
+	var stream io.ReadCloser
+	var err error
+
+	// The logs can be streamed once the container started, give up after 10 minutes of waiting
+	for attempt := 0; attempt < 300; attempt++ {
+		stream, err = clientset.CoreV1().Pods(namespace).GetLogs(podName, &apiv1.PodLogOptions{Container: containerName, Follow: true}).Stream(context.TODO())
+		if err == nil || errors.IsNotFound(err) {
+			break
+		}
+		time.Sleep(2 * time.Second)
+	}
+	if err != nil {
+		failOnError(err, "Failed to stream the logs of "+podName+"/"+containerName)
+		return
+	}
+	defer stream.Close()
+
+	writer, err := logStore.Create(runId, logName)
+	if err != nil {
+		failOnError(err, "Failed to store the logs of "+podName+"/"+containerName)
+		return
+	}
+	defer writer.Close()
+	gzipWriter := gzip.NewWriter(writer)
+	defer gzipWriter.Close()
+
+	reader := bufio.NewReader(stream)
+	for {
+		line, err := reader.ReadString('\n')
+		if len(line) > 0 {
+			if _, err := io.WriteString(gzipWriter, masker.Replace(line)); err != nil {
+				failOnError(err, "Failed to store the logs of "+podName+"/"+containerName)
+				return
+			}
+		}
+		if err != nil {
+			if err != io.EOF {
+				failOnError(err, "Failed to read the logs of "+podName+"/"+containerName)
+			}
+			return
+		}
+	}
+}
+
+// Returns the number of pods of the job created before pod, 0 for its first pod
+func getPodRetry(pod *apiv1.Pod, jobName string) int {
+	pods, err := clientset.CoreV1().Pods(namespace).List(context.TODO(), metav1.ListOptions{LabelSelector: "job-name=" + jobName})
+	if err != nil {
+		failOnError(err, "Failed to list the pods of job "+jobName)
+		return 0
+	}
+	retry := 0
+	for _, other := range pods.Items {
+		if other.UID != pod.UID && other.CreationTimestamp.Before(&pod.CreationTimestamp) {
+			retry++
+		}
+	}
+	return retry
+}
+
+// Starts following the logs of every container of a job pod once it runs, called by watchJobPods. A pod only seen
+// finished is archived from the logs left until its TTL deletion. The logs of the pods retrying the job are stored
+// as <container>-retry-<n>
+func archivePodLogs(pod *apiv1.Pod) {
+	jobName := pod.Labels["job-name"]
+	if jobName == "" || pod.Status.Phase == apiv1.PodPending || pod.Status.Phase == apiv1.PodUnknown {
+		return
+	}
+
+	archivedPodsMutex.Lock()
+	defer archivedPodsMutex.Unlock()
+	if _, ok := archivedPods[pod.UID]; ok {
+		return
+	}
+	for uid, archivedAt := range archivedPods {
+		if time.Since(archivedAt) > 24*time.Hour {
+			delete(archivedPods, uid)
+		}
+	}
+	archivedPods[pod.UID] = time.Now()
+
+	retry := getPodRetry(pod, jobName)
+	masker := getPodSecretsMasker(pod.Spec)
+	for _, container := range append(pod.Spec.InitContainers, pod.Spec.Containers...) {
+		logName := container.Name
+		if retry > 0 {
+			logName += "-retry-" + strconv.Itoa(retry)
+		}
+		go archiveContainerLogs(jobName, pod.Name, container.Name, logName, masker)
+	}
+}
+
+func readContainerLogs(runId string, containerName string, w io.Writer) error {
+	reader, err := logStore.Open(runId, containerName)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	gzipReader, err := gzip.NewReader(reader)
+	if err != nil {
+		return err
+	}
+	defer gzipReader.Close()
+
+	_, err = io.Copy(w, gzipReader)
+	return err
+}
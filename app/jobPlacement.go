@@ -0,0 +1,278 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+	apiv1 "k8s.io/api/core/v1"
+)
+
+// Installation defaults of the job pods placement. JOB_NODE_SELECTOR is a comma separated list of key=value,
+// JOB_TOLERATIONS and JOB_AFFINITY are YAML or JSON in the Kubernetes pod spec format
+var defaultJobNodeSelector = getEnvNodeSelector("JOB_NODE_SELECTOR", "nodegroup-type=cicd-workloads")
+var defaultJobTolerations = getEnvTolerations("JOB_TOLERATIONS")
+var defaultJobAffinity = getEnvAffinity("JOB_AFFINITY")
+
+// Node labels a workflow may select, as comma separated key=value or key for any value of the label
+var nodeLabelAllowlist = getEnvList("JOB_NODE_LABEL_ALLOWLIST")
+
+// Toleration keys a workflow may declare, * allows tolerations without a key
+var tolerationAllowlist = getEnvList("JOB_TOLERATION_ALLOWLIST")
+
+type JobPlacement struct {
+	NodeSelector map[string]string
+	Tolerations  []apiv1.Toleration
+	Affinity     *apiv1.Affinity
+}
+
+func getEnvList(name string) []string {
+	var values []string
+	for _, value := range strings.Split(os.Getenv(name), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// Returns true when scope, org or org/repo, is the repository of the workflow or its org
+func isWorkflowRepository(scope string, scmWorkflowDetails *ScmWorkflowDetails) bool {
+	scope = strings.TrimSpace(scope)
+	return strings.EqualFold(scope, scmWorkflowDetails.GitOrgProject) ||
+		strings.EqualFold(scope, scmWorkflowDetails.GitOrgProject+"/"+scmWorkflowDetails.GitRepository)
+}
+
+// Returns the values of the allowlist entries applying to the repository of the workflow. An entry is a value
+// allowed to every repository, org=value or org/repo=value
+func getRepositoryAllowlist(allowlist []string, scmWorkflowDetails *ScmWorkflowDetails) []string {
+	var values []string
+	for _, entry := range allowlist {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) == 1 {
+			values = append(values, entry)
+		} else if isWorkflowRepository(parts[0], scmWorkflowDetails) {
+			values = append(values, strings.TrimSpace(parts[1]))
+		}
+	}
+	return values
+}
+
+// An empty but set variable removes the default node selector
+func getEnvNodeSelector(name string, defaultValue string) map[string]string {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		value = defaultValue
+	}
+
+	nodeSelector := map[string]string{}
+	for _, pair := range strings.Split(value, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		keyValue := strings.SplitN(pair, "=", 2)
+		if len(keyValue) != 2 {
+			log.Printf("Ignoring %s entry %q, expected key=value\n", name, pair)
+			continue
+		}
+		nodeSelector[strings.TrimSpace(keyValue[0])] = strings.TrimSpace(keyValue[1])
+	}
+	return nodeSelector
+}
+
+// Converts a value decoded from YAML to a Kubernetes API type, which only carries JSON field names
+func convertKubernetesValue(value interface{}, target interface{}) error {
+	content, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(content, target)
+}
+
+func parseEnvKubernetesValue(name string, target interface{}) bool {
+	content := os.Getenv(name)
+	if content == "" {
+		return false
+	}
+	var value interface{}
+	if err := yaml.Unmarshal([]byte(content), &value); err != nil {
+		log.Printf("Ignoring %s: %s\n", name, err)
+		return false
+	}
+	if err := convertKubernetesValue(value, target); err != nil {
+		log.Printf("Ignoring %s: %s\n", name, err)
+		return false
+	}
+	return true
+}
+
+func getEnvTolerations(name string) []apiv1.Toleration {
+	var tolerations []apiv1.Toleration
+	parseEnvKubernetesValue(name, &tolerations)
+	return tolerations
+}
+
+func getEnvAffinity(name string) *apiv1.Affinity {
+	affinity := &apiv1.Affinity{}
+	if !parseEnvKubernetesValue(name, affinity) {
+		return nil
+	}
+	return affinity
+}
+
+func isNodeLabelAllowed(key string, value string) bool {
+	for _, allowed := range nodeLabelAllowlist {
+		if allowed == key || allowed == key+"="+value {
+			return true
+		}
+	}
+	return false
+}
+
+func checkNodeSelectorRequirements(field string, requirements []apiv1.NodeSelectorRequirement) error {
+	for _, requirement := range requirements {
+		// Only In lists the selected values, the other operators need the whole label to be allowed
+		if requirement.Operator == apiv1.NodeSelectorOpIn {
+			for _, value := range requirement.Values {
+				if !isNodeLabelAllowed(requirement.Key, value) {
+					return fmt.Errorf("%s: node label %s=%s is not allowed", field, requirement.Key, value)
+				}
+			}
+		} else if !containsString(nodeLabelAllowlist, requirement.Key) {
+			return fmt.Errorf("%s: operator %s on node label %s is not allowed", field, requirement.Operator, requirement.Key)
+		}
+	}
+	return nil
+}
+
+// Only node affinity is accepted from workflows, each of its terms being checked against the node label allowlist
+func checkAffinity(affinity *apiv1.Affinity) error {
+	if affinity.PodAffinity != nil || affinity.PodAntiAffinity != nil {
+		return fmt.Errorf("workflow.kubernetes.affinity: only nodeAffinity is allowed")
+	}
+	nodeAffinity := affinity.NodeAffinity
+	if nodeAffinity == nil {
+		return nil
+	}
+
+	var terms []apiv1.NodeSelectorTerm
+	if nodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution != nil {
+		terms = append(terms, nodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms...)
+	}
+	for _, preferred := range nodeAffinity.PreferredDuringSchedulingIgnoredDuringExecution {
+		terms = append(terms, preferred.Preference)
+	}
+	for _, term := range terms {
+		if err := checkNodeSelectorRequirements("workflow.kubernetes.affinity", term.MatchExpressions); err != nil {
+			return err
+		}
+		if len(term.MatchFields) > 0 {
+			return fmt.Errorf("workflow.kubernetes.affinity: matchFields is not allowed")
+		}
+	}
+	return nil
+}
+
+// Returns the default affinity restricted by the node affinity of the workflow. Node selector terms being ORed, each
+// default term is combined with each workflow term, so a node has to match both. Preferences are added to the default
+// ones
+func mergeAffinity(defaultAffinity *apiv1.Affinity, affinity *apiv1.Affinity) *apiv1.Affinity {
+	if defaultAffinity == nil {
+		return affinity
+	}
+	merged := defaultAffinity.DeepCopy()
+	if affinity.NodeAffinity == nil {
+		return merged
+	}
+	if merged.NodeAffinity == nil {
+		merged.NodeAffinity = &apiv1.NodeAffinity{}
+	}
+
+	if required := affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution; required != nil && len(required.NodeSelectorTerms) > 0 {
+		defaultRequired := merged.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution
+		if defaultRequired == nil || len(defaultRequired.NodeSelectorTerms) == 0 {
+			merged.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution = required.DeepCopy()
+		} else {
+			var terms []apiv1.NodeSelectorTerm
+			for _, defaultTerm := range defaultRequired.NodeSelectorTerms {
+				for _, term := range required.NodeSelectorTerms {
+					combined := defaultTerm.DeepCopy()
+					combined.MatchExpressions = append(combined.MatchExpressions, term.MatchExpressions...)
+					terms = append(terms, *combined)
+				}
+			}
+			defaultRequired.NodeSelectorTerms = terms
+		}
+	}
+	merged.NodeAffinity.PreferredDuringSchedulingIgnoredDuringExecution = append(merged.NodeAffinity.PreferredDuringSchedulingIgnoredDuringExecution, affinity.NodeAffinity.PreferredDuringSchedulingIgnoredDuringExecution...)
+	return merged
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Merges the workflow nodeSelector, tolerations and affinity over the installation defaults, after checking them
+// against the allowlists. Workflow node selector keys override the default ones, its node affinity further restricts
+// the default affinity and its tolerations are added to the default ones
+func getJobPlacement(workflowKubernetes WorkflowKubernetes) (JobPlacement, error) {
+	placement := JobPlacement{
+		NodeSelector: map[string]string{},
+		Tolerations:  append([]apiv1.Toleration{}, defaultJobTolerations...),
+		Affinity:     defaultJobAffinity,
+	}
+	for key, value := range defaultJobNodeSelector {
+		placement.NodeSelector[key] = value
+	}
+
+	keys := make([]string, 0, len(workflowKubernetes.NodeSelector))
+	for key := range workflowKubernetes.NodeSelector {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := workflowKubernetes.NodeSelector[key]
+		if !isNodeLabelAllowed(key, value) {
+			return JobPlacement{}, fmt.Errorf("workflow.kubernetes.nodeSelector: node label %s=%s is not allowed", key, value)
+		}
+		placement.NodeSelector[key] = value
+	}
+
+	if workflowKubernetes.Tolerations != nil {
+		var tolerations []apiv1.Toleration
+		if err := convertKubernetesValue(workflowKubernetes.Tolerations, &tolerations); err != nil {
+			return JobPlacement{}, fmt.Errorf("workflow.kubernetes.tolerations: %s", err)
+		}
+		for _, toleration := range tolerations {
+			key := toleration.Key
+			if key == "" {
+				key = "*"
+			}
+			if !containsString(tolerationAllowlist, key) {
+				return JobPlacement{}, fmt.Errorf("workflow.kubernetes.tolerations: toleration of %s is not allowed", key)
+			}
+		}
+		placement.Tolerations = append(placement.Tolerations, tolerations...)
+	}
+
+	if workflowKubernetes.Affinity != nil {
+		affinity := &apiv1.Affinity{}
+		if err := convertKubernetesValue(workflowKubernetes.Affinity, affinity); err != nil {
+			return JobPlacement{}, fmt.Errorf("workflow.kubernetes.affinity: %s", err)
+		}
+		if err := checkAffinity(affinity); err != nil {
+			return JobPlacement{}, err
+		}
+		placement.Affinity = mergeAffinity(defaultJobAffinity, affinity)
+	}
+	return placement, nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	apiv1 "k8s.io/api/core/v1"
+)
+
+func TestMergeAffinity(t *testing.T) {
+	requirement := func(key string, values ...string) apiv1.NodeSelectorRequirement {
+		return apiv1.NodeSelectorRequirement{Key: key, Operator: apiv1.NodeSelectorOpIn, Values: values}
+	}
+	nodeAffinity := func(terms [][]apiv1.NodeSelectorRequirement, preferred ...apiv1.PreferredSchedulingTerm) *apiv1.Affinity {
+		affinity := &apiv1.Affinity{NodeAffinity: &apiv1.NodeAffinity{PreferredDuringSchedulingIgnoredDuringExecution: preferred}}
+		if len(terms) > 0 {
+			affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution = &apiv1.NodeSelector{}
+			for _, expressions := range terms {
+				affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms = append(
+					affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms, apiv1.NodeSelectorTerm{MatchExpressions: expressions})
+			}
+		}
+		return affinity
+	}
+	preferSsd := apiv1.PreferredSchedulingTerm{Weight: 10, Preference: apiv1.NodeSelectorTerm{MatchExpressions: []apiv1.NodeSelectorRequirement{requirement("disk", "ssd")}}}
+	podAntiAffinity := &apiv1.PodAntiAffinity{PreferredDuringSchedulingIgnoredDuringExecution: []apiv1.WeightedPodAffinityTerm{{Weight: 1}}}
+
+	tests := []struct {
+		name            string
+		defaultAffinity *apiv1.Affinity
+		affinity        *apiv1.Affinity
+		want            *apiv1.Affinity
+	}{
+		{
+			name:     "no default",
+			affinity: nodeAffinity([][]apiv1.NodeSelectorRequirement{{requirement("arch", "arm64")}}),
+			want:     nodeAffinity([][]apiv1.NodeSelectorRequirement{{requirement("arch", "arm64")}}),
+		},
+		{
+			name:            "required terms are combined",
+			defaultAffinity: nodeAffinity([][]apiv1.NodeSelectorRequirement{{requirement("pool", "cicd")}, {requirement("pool", "spot")}}),
+			affinity:        nodeAffinity([][]apiv1.NodeSelectorRequirement{{requirement("arch", "arm64")}}),
+			want: nodeAffinity([][]apiv1.NodeSelectorRequirement{
+				{requirement("pool", "cicd"), requirement("arch", "arm64")},
+				{requirement("pool", "spot"), requirement("arch", "arm64")},
+			}),
+		},
+		{
+			name:            "preferences are added",
+			defaultAffinity: nodeAffinity([][]apiv1.NodeSelectorRequirement{{requirement("pool", "cicd")}}),
+			affinity:        nodeAffinity(nil, preferSsd),
+			want:            nodeAffinity([][]apiv1.NodeSelectorRequirement{{requirement("pool", "cicd")}}, preferSsd),
+		},
+		{
+			name:            "default pod anti affinity is kept",
+			defaultAffinity: &apiv1.Affinity{PodAntiAffinity: podAntiAffinity},
+			affinity:        nodeAffinity([][]apiv1.NodeSelectorRequirement{{requirement("arch", "arm64")}}),
+			want: &apiv1.Affinity{
+				PodAntiAffinity: podAntiAffinity,
+				NodeAffinity:    nodeAffinity([][]apiv1.NodeSelectorRequirement{{requirement("arch", "arm64")}}).NodeAffinity,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var defaultCopy *apiv1.Affinity
+			if test.defaultAffinity != nil {
+				defaultCopy = test.defaultAffinity.DeepCopy()
+			}
+			merged := mergeAffinity(test.defaultAffinity, test.affinity)
+			if !reflect.DeepEqual(merged, test.want) {
+				t.Errorf("got %+v, want %+v", merged, test.want)
+			}
+			if !reflect.DeepEqual(test.defaultAffinity, defaultCopy) {
+				t.Errorf("the default affinity was modified")
+			}
+		})
+	}
+}
+
+func TestGetRepositoryAllowlist(t *testing.T) {
+	allowlist := []string{"shared", "agnops=org-wide", "agnops/job-generator=repository", "agnops/examples=other", "other=elsewhere"}
+	details := &ScmWorkflowDetails{GitOrgProject: "AgnOps", GitRepository: "job-generator"}
+	want := []string{"shared", "org-wide", "repository"}
+	if got := getRepositoryAllowlist(allowlist, details); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Maximum number of unfinished jobs, 0 for no limit. Jobs over a limit wait in the queue
+var maxConcurrentJobs = getEnvInt("MAX_CONCURRENT_JOBS", 0)
+var maxConcurrentJobsPerOrg = getEnvInt("MAX_CONCURRENT_JOBS_PER_ORG", 0)
+var maxConcurrentJobsPerRepo = getEnvInt("MAX_CONCURRENT_JOBS_PER_REPO", 0)
+
+// Highest kubernetes.priority a workflow may set, higher ones are lowered to it. MAX_JOB_PRIORITY_OVERRIDES holds comma
+// separated org=priority or org/repo=priority entries, the entry of the repository winning over the one of its org
+var maxJobPriority = getEnvInt("MAX_JOB_PRIORITY", 10)
+var maxJobPriorityOverrides = getEnvList("MAX_JOB_PRIORITY_OVERRIDES")
+
+// Serializes the queue scheduling, so a queued job is never created twice
+var jobQueueMutex sync.Mutex
+
+// A job waiting for a slot, persisted in a Secret labeled AgnOps: queued as its spec holds the OAuth token
+type queuedJob struct {
+	Job        *batchv1.Job
+	Priority   int
+	QueuedAt   time.Time
+	SecretName string
+}
+
+type QueuedRun struct {
+	Position   int       `json:"position"`
+	Id         string    `json:"id"`
+	Org        string    `json:"org"`
+	Repository string    `json:"repository"`
+	Workflow   string    `json:"workflow"`
+	CommitId   string    `json:"commitId"`
+	Priority   int       `json:"priority"`
+	QueuedAt   time.Time `json:"queuedAt"`
+}
+
+func isJobQueueEnabled() bool {
+	return maxConcurrentJobs > 0 || maxConcurrentJobsPerOrg > 0 || maxConcurrentJobsPerRepo > 0
+}
+
+func getQueuedJobSecretName(jobName string) string {
+	return "agnops-queued-" + jobName
+}
+
+func getJobRepository(job *batchv1.Job) string {
+	return job.Annotations["agnops/org"] + "/" + job.Annotations["agnops/repository"]
+}
+
+func getMaxJobPriority(org string, repository string) int {
+	maxPriority := maxJobPriority
+	for _, entry := range maxJobPriorityOverrides {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		priority, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil {
+			log.Printf("Ignoring the MAX_JOB_PRIORITY_OVERRIDES entry %q: %s\n", entry, err)
+			continue
+		}
+		switch scope := strings.TrimSpace(parts[0]); {
+		case strings.EqualFold(scope, org+"/"+repository):
+			return priority
+		case strings.EqualFold(scope, org):
+			maxPriority = priority
+		}
+	}
+	return maxPriority
+}
+
+// Returns the queue priority of the workflow, lowered to the maximum of its repository
+func getJobPriority(scmWorkflowDetails *ScmWorkflowDetails) int {
+	priority := scmWorkflowDetails.Workflow.WorkflowYaml.Workflow.Kubernetes.Priority
+	maxPriority := getMaxJobPriority(scmWorkflowDetails.GitOrgProject, scmWorkflowDetails.GitRepository)
+	if priority > maxPriority {
+		log.Printf("Lowering the priority %d of workflow %s to the maximum %d of %s/%s\n", priority, scmWorkflowDetails.Workflow.FileName, maxPriority, scmWorkflowDetails.GitOrgProject, scmWorkflowDetails.GitRepository)
+		return maxPriority
+	}
+	return priority
+}
+
+func enqueueJob(job *batchv1.Job, priority int) error {
+	content, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+
+	labels := map[string]string{"AgnOps": "queued"}
+	if concurrencyGroup := job.Labels["agnops/concurrency-group"]; concurrencyGroup != "" {
+		labels["agnops/concurrency-group"] = concurrencyGroup
+	}
+	secretSpec := apiv1.Secret{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "Secret",
+			APIVersion: "v1",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      getQueuedJobSecretName(job.Name),
+			Namespace: namespace,
+			Labels:    labels,
+		},
+		Data: map[string][]byte{
+			"Job":      content,
+			"Priority": []byte(strconv.Itoa(priority)),
+			"QueuedAt": []byte(time.Now().UTC().Format(time.RFC3339Nano)),
+		},
+		Type: "Opaque",
+	}
+
+	_, err = secretsClient.Create(context.TODO(), &secretSpec, metav1.CreateOptions{})
+	if err != nil {
+		return err
+	}
+	log.Printf("Queued job %s\n", job.Name)
+	queueJobCommitStatus(job, JobQueued)
+	return nil
+}
+
+// Returns the queued jobs matching the label selector, highest priority first then first queued first
+func listQueuedJobs(labelSelector string) ([]*queuedJob, error) {
+	secrets, err := secretsClient.List(context.TODO(), metav1.ListOptions{LabelSelector: labelSelector})
+	if err != nil {
+		return nil, err
+	}
+
+	var queuedJobs []*queuedJob
+	for _, secret := range secrets.Items {
+		job := &batchv1.Job{}
+		if err := json.Unmarshal(secret.Data["Job"], job); err != nil {
+			log.Printf("Ignoring queued job %s: %s\n", secret.Name, err)
+			continue
+		}
+		priority, _ := strconv.Atoi(string(secret.Data["Priority"]))
+		queuedAt, _ := time.Parse(time.RFC3339Nano, string(secret.Data["QueuedAt"]))
+		queuedJobs = append(queuedJobs, &queuedJob{Job: job, Priority: priority, QueuedAt: queuedAt, SecretName: secret.Name})
+	}
+	sort.SliceStable(queuedJobs, func(i, j int) bool {
+		if queuedJobs[i].Priority != queuedJobs[j].Priority {
+			return queuedJobs[i].Priority > queuedJobs[j].Priority
+		}
+		return queuedJobs[i].QueuedAt.Before(queuedJobs[j].QueuedAt)
+	})
+	return queuedJobs, nil
+}
+
+// Creates the queued jobs fitting the global, per org and per repository limits. A job held back by its org or
+// repository limit does not block the jobs of other repositories
+func scheduleQueuedJobs() {
+	jobQueueMutex.Lock()
+	defer jobQueueMutex.Unlock()
+
+	queuedJobs, err := listQueuedJobs("AgnOps=queued")
+	if err != nil {
+		failOnError(err, "Failed to list the queued jobs")
+		return
+	}
+	if len(queuedJobs) == 0 {
+		return
+	}
+
+	jobsClient := clientset.BatchV1().Jobs(namespace)
+	jobs, err := jobsClient.List(context.TODO(), metav1.ListOptions{LabelSelector: "agnops=job"})
+	if err != nil {
+		failOnError(err, "Failed to list the jobs")
+		return
+	}
+
+	running := 0
+	runningPerOrg := map[string]int{}
+	runningPerRepo := map[string]int{}
+	for i := range jobs.Items {
+		job := &jobs.Items[i]
+		if isJobFinished(getJobState(job)) {
+			continue
+		}
+		running++
+		runningPerOrg[job.Annotations["agnops/org"]]++
+		runningPerRepo[getJobRepository(job)]++
+	}
+
+	for _, queued := range queuedJobs {
+		if maxConcurrentJobs > 0 && running >= maxConcurrentJobs {
+			break
+		}
+		org := queued.Job.Annotations["agnops/org"]
+		repository := getJobRepository(queued.Job)
+		if maxConcurrentJobsPerOrg > 0 && runningPerOrg[org] >= maxConcurrentJobsPerOrg {
+			continue
+		}
+		if maxConcurrentJobsPerRepo > 0 && runningPerRepo[repository] >= maxConcurrentJobsPerRepo {
+			continue
+		}
+
+		log.Printf("Creating queued job %s\n", queued.Job.Name)
+		_, err := jobsClient.Create(context.TODO(), queued.Job, metav1.CreateOptions{})
+		if err != nil && !errors.IsAlreadyExists(err) {
+			failOnError(err, "Failed on queued job creation")
+			continue
+		}
+		err = secretsClient.Delete(context.TODO(), queued.SecretName, metav1.DeleteOptions{})
+		failOnError(err, "Failed to dequeue the job "+queued.Job.Name)
+
+		running++
+		runningPerOrg[org]++
+		runningPerRepo[repository]++
+	}
+}
+
+// Drops the queued jobs of a concurrency group generated before createdAt for another commit, and reports them
+// cancelled like the running jobs of the group
+func cancelQueuedJobs(concurrencyGroup string, commitId string, createdAt time.Time) {
+	jobQueueMutex.Lock()
+	defer jobQueueMutex.Unlock()
+
+	queuedJobs, err := listQueuedJobs("AgnOps=queued,agnops/concurrency-group=" + getConcurrencyGroupLabel(concurrencyGroup))
+	if err != nil {
+		failOnError(err, "Failed to list the queued jobs of concurrency group "+concurrencyGroup)
+		return
+	}
+
+	for _, queued := range queuedJobs {
+		if queued.Job.Annotations["agnops/commit"] == commitId || !getJobCreatedAt(queued.Job).Before(createdAt) {
+			continue
+		}
+		log.Printf("Cancelling queued job %s, superseded by commit %s in concurrency group %s\n", queued.Job.Name, commitId, concurrencyGroup)
+		err := secretsClient.Delete(context.TODO(), queued.SecretName, metav1.DeleteOptions{})
+		if err != nil {
+			failOnError(err, "Failed to cancel the queued job "+queued.Job.Name)
+			continue
+		}
+		err = updateRunRecord(queued.Job.Name, func(runRecord *RunRecord) {
+			runRecord.Reason = "superseded by commit " + commitId
+		})
+		failOnError(err, "Failed to record the cancellation of job "+queued.Job.Name)
+
+		// Notified in the background, as the handlers schedule the queue, locked here
+		go notifyJobState(queued.Job, JobCancelled)
+	}
+}
+
+// Frees the slot of a finished job
+func releaseJobSlot(job *batchv1.Job, state string) {
+	if isJobFinished(state) && isJobQueueEnabled() {
+		scheduleQueuedJobs()
+	}
+}
+
+// Schedules the queue every 30 seconds, which also resumes it after a restart
+func runJobQueue() {
+	if !isJobQueueEnabled() {
+		return
+	}
+	for {
+		scheduleQueuedJobs()
+		time.Sleep(30 * time.Second)
+	}
+}
+
+// Returns the 1-based position of a queued run, or 0 when it is not queued
+func getQueuePosition(runId string) (int, error) {
+	queuedJobs, err := listQueuedJobs("AgnOps=queued")
+	if err != nil {
+		return 0, err
+	}
+	for i, queued := range queuedJobs {
+		if queued.Job.Name == runId {
+			return i + 1, nil
+		}
+	}
+	return 0, nil
+}
+
+// GET /api/queue, the queued runs in the order they will be created
+func QueueHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJsonError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	queuedJobs, err := listQueuedJobs("AgnOps=queued")
+	if err != nil {
+		writeJsonError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	queuedRuns := []QueuedRun{}
+	for i, queued := range queuedJobs {
+		queuedRuns = append(queuedRuns, QueuedRun{
+			Position:   i + 1,
+			Id:         queued.Job.Name,
+			Org:        queued.Job.Annotations["agnops/org"],
+			Repository: queued.Job.Annotations["agnops/repository"],
+			Workflow:   queued.Job.Annotations["agnops/workflow"],
+			CommitId:   queued.Job.Annotations["agnops/commit"],
+			Priority:   queued.Priority,
+			QueuedAt:   queued.QueuedAt,
+		})
+	}
+	writeJson(w, http.StatusOK, queuedRuns)
+}
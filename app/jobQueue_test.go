@@ -0,0 +1,33 @@
+package main
+
+import "testing"
+
+func TestGetMaxJobPriority(t *testing.T) {
+	previousMaxJobPriority, previousOverrides := maxJobPriority, maxJobPriorityOverrides
+	defer func() { maxJobPriority, maxJobPriorityOverrides = previousMaxJobPriority, previousOverrides }()
+	maxJobPriority = 10
+	maxJobPriorityOverrides = []string{"agnops/job-generator=50", "AgnOps=20", "invalid", "other=x"}
+
+	tests := []struct {
+		org        string
+		repository string
+		want       int
+	}{
+		{org: "agnops", repository: "job-generator", want: 50},
+		{org: "agnops", repository: "examples", want: 20},
+		{org: "other", repository: "job-generator", want: 10},
+	}
+	for _, test := range tests {
+		if got := getMaxJobPriority(test.org, test.repository); got != test.want {
+			t.Errorf("getMaxJobPriority(%q, %q) = %d, want %d", test.org, test.repository, got, test.want)
+		}
+	}
+
+	details := &ScmWorkflowDetails{GitOrgProject: "other", GitRepository: "job-generator"}
+	for priority, want := range map[int]int{-5: -5, 10: 10, 1000: 10} {
+		details.Workflow.WorkflowYaml.Workflow.Kubernetes.Priority = priority
+		if got := getJobPriority(details); got != want {
+			t.Errorf("getJobPriority with priority %d = %d, want %d", priority, got, want)
+		}
+	}
+}
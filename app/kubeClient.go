@@ -2,8 +2,9 @@ package main
 
 import (
 	"context"
+	"crypto/sha1"
+	"encoding/hex"
 	"flag"
-	"fmt"
 	batchv1 "k8s.io/api/batch/v1"
 	apiv1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
@@ -18,10 +19,12 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
-	//"k8s.io/apimachinery/pkg/api/errors"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
 )
 
-var clientset *kubernetes.Clientset
+var clientset kubernetes.Interface
 var secretsClient coreV1Types.SecretInterface
 var configMapClient coreV1Types.ConfigMapInterface
 
@@ -39,28 +42,135 @@ func getResourceList(cpu, memory string) apiv1.ResourceList {
 	return res
 }
 
-func getJobName(scmWorkflowDetails *ScmWorkflowDetails, jobId int) string {
-	filename := regexp.MustCompile(`[^a-zA-Z0-9-]`).ReplaceAllString(strings.Replace(strings.ToLower(scmWorkflowDetails.Workflow.FileName), ".yaml", "", -1), "-")
-	gitOrgProject := regexp.MustCompile(`[^a-zA-Z0-9-]`).ReplaceAllString(strings.ToLower(scmWorkflowDetails.GitOrgProject), "-")
-	gitRepository := regexp.MustCompile(`[^a-zA-Z0-9-]`).ReplaceAllString(strings.ToLower(scmWorkflowDetails.GitRepository), "-")
-	branch := regexp.MustCompile(`[^a-zA-Z0-9-]`).ReplaceAllString(strings.ToLower(scmWorkflowDetails.Branch), "-")
-	jobName := fmt.Sprintf("%s-%s-%s-%s-%s", gitOrgProject, gitRepository, branch, scmWorkflowDetails.CommitId[len(scmWorkflowDetails.CommitId)-7:], filename)
-	if len(jobName) > 62 {
-		jobName = jobName[0:62]
+// Lowercases the value and replaces the runs of characters invalid in a DNS label with a dash
+func sanitizeName(value string) string {
+	return strings.Trim(regexp.MustCompile(`[^a-z0-9]+`).ReplaceAllString(strings.ToLower(value), "-"), "-")
+}
+
+// Returns the value with the characters invalid in a label value replaced, cut to 63 characters
+func getLabelValue(value string) string {
+	value = regexp.MustCompile(`[^A-Za-z0-9._-]+`).ReplaceAllString(value, "-")
+	if len(value) > 63 {
+		value = value[:63]
+	}
+	return strings.Trim(value, "._-")
+}
+
+func getRunAttempt(scmWorkflowDetails *ScmWorkflowDetails) int {
+	if scmWorkflowDetails.Attempt < 1 {
+		return 1
+	}
+	return scmWorkflowDetails.Attempt
+}
+
+// Returns a readable prefix of the org, repository, branch and workflow, followed by a hash of the repository,
+// commit, workflow path, matrix combination and run attempt. The name stays the same whatever the order of the
+// workflows, and two runs only share it when they share all of those
+func getJobName(scmWorkflowDetails *ScmWorkflowDetails) string {
+	identity := strings.Join([]string{
+		scmWorkflowDetails.ScProvider,
+		scmWorkflowDetails.GitOrgProject + "/" + scmWorkflowDetails.GitRepository,
+		scmWorkflowDetails.CommitId,
+		scmWorkflowDetails.Workflow.FileName,
+		getMatrixDescription(scmWorkflowDetails.Matrix),
+		strconv.Itoa(getRunAttempt(scmWorkflowDetails)),
+	}, "\n")
+	hash := sha1.Sum([]byte(identity))
+	suffix := hex.EncodeToString(hash[:])[:10]
+
+	workflowName := strings.TrimSuffix(strings.TrimSuffix(scmWorkflowDetails.Workflow.FileName, ".yaml"), ".yml")
+	prefix := sanitizeName(strings.Join([]string{scmWorkflowDetails.GitOrgProject, scmWorkflowDetails.GitRepository, scmWorkflowDetails.Branch, workflowName}, "-"))
+	if len(prefix) > 63-len(suffix)-1 {
+		prefix = strings.TrimRight(prefix[:63-len(suffix)-1], "-")
+	}
+	if prefix == "" {
+		prefix = "agnops"
 	}
-	jobName = regexp.MustCompile(`[^0-9]$`).ReplaceAllString(jobName, "")
-	jobName = jobName + strconv.Itoa(jobId)
+	return prefix + "-" + suffix
+}
 
-	return jobName
+func getShortCommitId(commitId string) string {
+	if len(commitId) > 7 {
+		return commitId[:7]
+	}
+	return commitId
 }
 
-func createJobObject(scmWorkflowDetails *ScmWorkflowDetails, jobId int) {
-	jobName := getJobName(scmWorkflowDetails, jobId)
+// Labels of the job and its pods, for kubectl selectors, dashboards and cleanup tools
+func getJobLabels(scmWorkflowDetails *ScmWorkflowDetails, jobName string) map[string]string {
+	labels := map[string]string{
+		"agnops":            "job",
+		"agnops/run-id":     jobName,
+		"agnops/provider":   getLabelValue(scmWorkflowDetails.ScProvider),
+		"agnops/org":        getLabelValue(scmWorkflowDetails.GitOrgProject),
+		"agnops/repository": getLabelValue(scmWorkflowDetails.GitRepository),
+		"agnops/branch":     getLabelValue(sanitizeName(scmWorkflowDetails.Branch)),
+		"agnops/commit":     getLabelValue(scmWorkflowDetails.CommitId),
+		"agnops/short-sha":  getLabelValue(getShortCommitId(scmWorkflowDetails.CommitId)),
+		"agnops/workflow":   getLabelValue(scmWorkflowDetails.Workflow.FileName),
+		"agnops/event":      getLabelValue(scmWorkflowDetails.Event),
+		"agnops/attempt":    strconv.Itoa(getRunAttempt(scmWorkflowDetails)),
+	}
+	if scmWorkflowDetails.Tag != "" {
+		labels["agnops/tag"] = getLabelValue(scmWorkflowDetails.Tag)
+	}
+	if matrixCellId := getMatrixCellId(scmWorkflowDetails.Matrix); matrixCellId != "" {
+		labels["agnops/matrix-cell"] = matrixCellId
+	}
+	if concurrencyGroup := getConcurrencyGroup(scmWorkflowDetails); concurrencyGroup != "" {
+		labels["agnops/concurrency-group"] = getConcurrencyGroupLabel(concurrencyGroup)
+	}
+	return labels
+}
+
+func getPodLabels(jobLabels map[string]string, jobName string) map[string]string {
+	labels := map[string]string{"job_name": jobName}
+	for key, value := range jobLabels {
+		labels[key] = value
+	}
+	return labels
+}
+
+// Annotations hold the full values the labels shorten or sanitize, and the ones read back by the job controller
+func getJobAnnotations(scmWorkflowDetails *ScmWorkflowDetails) map[string]string {
+	annotations := map[string]string{
+		"agnops/dependency-group": getDependencyGroup(scmWorkflowDetails),
+		"agnops/workflow":         scmWorkflowDetails.Workflow.FileName,
+		"agnops/provider":         scmWorkflowDetails.ScProvider,
+		"agnops/org":              scmWorkflowDetails.GitOrgProject,
+		"agnops/repository":       scmWorkflowDetails.GitRepository,
+		"agnops/project-id":       scmWorkflowDetails.ProjectId,
+		"agnops/branch":           scmWorkflowDetails.Branch,
+		"agnops/commit":           scmWorkflowDetails.CommitId,
+		"agnops/commit-url":       scmWorkflowDetails.CommitUrl,
+		"agnops/commit-message":   scmWorkflowDetails.CommitMsg,
+		"agnops/author":           scmWorkflowDetails.Email,
+		"agnops/event":            scmWorkflowDetails.Event,
+		"agnops/attempt":          strconv.Itoa(getRunAttempt(scmWorkflowDetails)),
+	}
+	if scmWorkflowDetails.Tag != "" {
+		annotations["agnops/tag"] = scmWorkflowDetails.Tag
+	}
+	if len(scmWorkflowDetails.Matrix) > 0 {
+		annotations["agnops/matrix"] = getMatrixDescription(scmWorkflowDetails.Matrix)
+	}
+	if len(scmWorkflowDetails.Workflow.SkippedContainers) > 0 {
+		annotations["agnops/skipped-containers"] = strings.Join(scmWorkflowDetails.Workflow.SkippedContainers, "\n")
+	}
+	if concurrencyGroup := getConcurrencyGroup(scmWorkflowDetails); concurrencyGroup != "" {
+		annotations["agnops/concurrency-group"] = concurrencyGroup
+	}
+	return annotations
+}
+
+func createJobObject(scmWorkflowDetails *ScmWorkflowDetails) error {
+	jobName := getJobName(scmWorkflowDetails)
 
 	sharedEnvs := []apiv1.EnvVar{
 		{Name: "COMMITID", Value: scmWorkflowDetails.CommitId},
 		{Name: "OAUTH_TOKEN", Value: scmWorkflowDetails.OAuthToken},
 	}
+	sharedEnvs = append(sharedEnvs, getUntrustedReferenceEnvs(scmWorkflowDetails)...)
 	initContainerEnvs := []apiv1.EnvVar{
 		{Name: "SCM_PROVIDER", Value: scmWorkflowDetails.ScProvider},
 		{Name: "OAUTH_TOKEN", Value: scmWorkflowDetails.OAuthToken},
@@ -77,6 +187,9 @@ func createJobObject(scmWorkflowDetails *ScmWorkflowDetails, jobId int) {
 		sharedEnvs = append(sharedEnvs, apiv1.EnvVar{Name: "REPO_NAME", Value: scmWorkflowDetails.Workflow.WorkflowYaml.Workflow.GlobalAddOns.RepoName})
 		initContainerEnvs = append(initContainerEnvs, apiv1.EnvVar{Name: "REPO_NAME", Value: scmWorkflowDetails.Workflow.WorkflowYaml.Workflow.GlobalAddOns.RepoName})
 	}
+	for _, key := range getSortedKeys(scmWorkflowDetails.Matrix) {
+		sharedEnvs = append(sharedEnvs, apiv1.EnvVar{Name: getMatrixEnvName(key), Value: scmWorkflowDetails.Matrix[key]})
+	}
 	if len(scmWorkflowDetails.Workflow.WorkflowYaml.Workflow.GlobalAddOns.DockerFilePath) > 0 {
 		sharedEnvs = append(sharedEnvs, apiv1.EnvVar{Name: "DOCKERFILE_PATH", Value: scmWorkflowDetails.Workflow.WorkflowYaml.Workflow.GlobalAddOns.DockerFilePath})
 	}
@@ -98,15 +211,39 @@ func createJobObject(scmWorkflowDetails *ScmWorkflowDetails, jobId int) {
 		sharedEmptyDir = apiv1.EmptyDirVolumeSource{Medium: "Memory", SizeLimit: &ramDiskSize}
 	}
 
+	caches := scmWorkflowDetails.Workflow.WorkflowYaml.Workflow.Caches
+	security := scmWorkflowDetails.Workflow.WorkflowYaml.Workflow.Kubernetes.Security
+	cachedImages := isCachedImageAllowed(scmWorkflowDetails)
 	var containers []apiv1.Container
+	var builders []string
+	usedBuilders := map[string]bool{}
 
 	for i, container := range scmWorkflowDetails.Workflow.WorkflowYaml.Workflow.Containers {
 		volumeMounts := []apiv1.VolumeMount{{MountPath: "/data", Name: "containers-data"}}
+		if len(caches) > 0 {
+			volumeMounts = append(volumeMounts, apiv1.VolumeMount{MountPath: cacheMountPath, Name: "agnops-cache"})
+		}
 		var envFrom []apiv1.EnvFromSource
-		args := ""
+		var waitFor []string
+		for _, service := range scmWorkflowDetails.Workflow.WorkflowYaml.Workflow.Services {
+			waitFor = append(waitFor, getServiceSidecarName(service))
+		}
 
-		if container.AddOns.IsDocker == true {
+		image := container.Image
+		builder := getContainerBuilder(container)
+		switch builder {
+		case BuilderDockerSocket:
 			volumeMounts = append(volumeMounts, []apiv1.VolumeMount{{MountPath: "/var/run/docker.sock", Name: "docker-sock"}, {MountPath: "/etc/docker/daemon.json", Name: "docker-daemon-json"}}...)
+		case BuilderDind, BuilderBuildKit:
+			waitFor = append(waitFor, getBuilderSidecarName(builder))
+		case BuilderKaniko:
+			if image == "" {
+				image = kanikoImage
+			}
+		}
+		if builder != "" && !usedBuilders[builder] {
+			usedBuilders[builder] = true
+			builders = append(builders, builder)
 		}
 
 		for _, envFromKey := range container.Kubernetes.EnvFrom {
@@ -117,73 +254,154 @@ func createJobObject(scmWorkflowDetails *ScmWorkflowDetails, jobId int) {
 		var resourcesLimits = getResourceList(container.Kubernetes.Resources.Limits.CPU, container.Kubernetes.Resources.Limits.Memory)
 		resources := apiv1.ResourceRequirements{Limits: resourcesLimits, Requests: resourcesRequests}
 
-		for _, cmd := range strings.Split(container.Command, "\n") {
-			if len(strings.TrimSpace(cmd)) > 0 {
-				args += fmt.Sprintf("\n%s;", cmd)
-			}
+		stepName := strconv.Itoa(i) + "-" + container.Name
+		env := append(append([]apiv1.EnvVar{}, sharedEnvs...), getStepEnvs(i, stepName, scmWorkflowDetails.Workflow.StepNeeds[i], container)...)
+		env = append(env, getBuilderEnvs(builder)...)
+		if len(caches) > 0 {
+			env = append(env, apiv1.EnvVar{Name: "AGNOPS_STEP_CACHES", Value: getStepCachesEnv(caches)})
 		}
-
-		postStart := "echo"
-
-		if i !=0 {
-			postStart = "while [ ! -f /data/container-" + strconv.Itoa(i) + " ]; do sleep 1; done"
+		if len(waitFor) > 0 {
+			env = append(env, apiv1.EnvVar{Name: "AGNOPS_STEP_WAIT_FOR", Value: strings.Join(waitFor, " ")})
+		}
+		if scmWorkflowDetails.Workflow.PassedSteps[container.Name] {
+			env = append(env, apiv1.EnvVar{Name: "AGNOPS_STEP_PASSED", Value: "true"})
 		}
+
 		containers = append(containers, apiv1.Container{
-			Name: 			 strconv.Itoa(i) + "-" + container.Name,
-			Image:           container.Image,
-			Lifecycle:		 &apiv1.Lifecycle{
-				PostStart: 	 &apiv1.Handler{
-					Exec:    &apiv1.ExecAction{Command: []string{"/bin/sh", "-c", postStart}},
-				},
-				PreStop: 	 &apiv1.Handler{
-					Exec:    &apiv1.ExecAction{Command: []string{"/bin/sh", "-c", "touch /data/container-" + strconv.Itoa(i+1)}},
-				},
-			},
-			ImagePullPolicy: "Always",
+			Name:            stepName,
+			Image:           image,
+			ImagePullPolicy: getWorkflowImagePullPolicy(image, container.PullPolicy, cachedImages),
+			SecurityContext: getContainerSecurityContext(getStepSecurity(security, builder)),
 			VolumeMounts:    volumeMounts,
-			Env:             sharedEnvs,
+			Env:             env,
 			EnvFrom:         envFrom,
 			Resources:       resources,
-			Command:         []string{"sh", "-c"},
-			Args:            append([]string{"cd /data/repo;" + args}),
+			Command:         []string{"sh", "-c", stepRunnerScript},
 		})
 	}
 
+	stepsCount := len(containers)
+	podAnnotations := map[string]string{}
+	for _, builder := range builders {
+		if sidecar := getBuilderSidecar(builder, stepsCount); sidecar != nil {
+			containers = append(containers, *sidecar)
+		}
+		for key, value := range getBuilderPodAnnotations(builder) {
+			podAnnotations[key] = value
+		}
+	}
+	containers = append(containers, getServiceSidecars(scmWorkflowDetails.Workflow.WorkflowYaml.Workflow.Services, stepsCount, cachedImages, getUntrustedReferenceEnvs(scmWorkflowDetails))...)
+	if uploader := getArtifactUploadContainer(scmWorkflowDetails, jobName); uploader != nil {
+		containers = append(containers, *uploader)
+	}
+	if len(caches) > 0 {
+		containers = append(containers, getCacheSaveContainer(stepsCount))
+	}
+
 	cdVolume := apiv1.Volume{Name: "containers-data", VolumeSource: apiv1.VolumeSource{EmptyDir: &sharedEmptyDir}}
-	hostPathType := apiv1.HostPathType("File")
-	dockerSockVolume := apiv1.Volume{Name: "docker-sock", VolumeSource: apiv1.VolumeSource{HostPath: &apiv1.HostPathVolumeSource{Path: "/var/run/docker.sock", Type: &hostPathType}}}
-	dockerDaemonJsonVolume := apiv1.Volume{Name: "docker-daemon-json", VolumeSource: apiv1.VolumeSource{HostPath: &apiv1.HostPathVolumeSource{Path: "/etc/docker/daemon.json", Type: &hostPathType}}}
-	backoffLimit := int32(0)
-	ttlSecondsAfterFinished := int32(20)
+	volumes := []apiv1.Volume{cdVolume}
+	// The host Docker socket is only mounted for the docker-socket builder, clusters forbidding hostPath run the others
+	if usedBuilders[BuilderDockerSocket] {
+		hostPathType := apiv1.HostPathType("File")
+		dockerSockVolume := apiv1.Volume{Name: "docker-sock", VolumeSource: apiv1.VolumeSource{HostPath: &apiv1.HostPathVolumeSource{Path: "/var/run/docker.sock", Type: &hostPathType}}}
+		dockerDaemonJsonVolume := apiv1.Volume{Name: "docker-daemon-json", VolumeSource: apiv1.VolumeSource{HostPath: &apiv1.HostPathVolumeSource{Path: "/etc/docker/daemon.json", Type: &hostPathType}}}
+		volumes = append(volumes, dockerSockVolume, dockerDaemonJsonVolume)
+	}
+
+	initContainers := []apiv1.Container{
+		{
+			Name:            "job-helper-init",
+			Image:           jobHelperImage,
+			ImagePullPolicy: getImagePullPolicy(jobHelperImage, ""),
+			VolumeMounts:    []apiv1.VolumeMount{{MountPath: "/data", Name: "containers-data"}},
+			Env:             initContainerEnvs,
+		},
+	}
+	if downloader := getArtifactDownloadContainer(scmWorkflowDetails, jobName); downloader != nil {
+		initContainers = append(initContainers, *downloader)
+	}
+	if len(caches) > 0 {
+		if err := ensureCacheVolume(scmWorkflowDetails); err != nil {
+			failOnError(err, "Failed to create the cache volume of job "+jobName)
+			return err
+		}
+		initContainers = append(initContainers, getCacheRestoreContainer(scmWorkflowDetails))
+		volumes = append(volumes, getCacheVolume(scmWorkflowDetails))
+	}
+	setDefaultImagePullPolicies(initContainers)
+	setDefaultImagePullPolicies(containers)
+	usesTmpVolume := setContainerSecurityContexts(initContainers, security)
+	if setContainerSecurityContexts(containers, security) || usesTmpVolume {
+		volumes = append(volumes, apiv1.Volume{Name: "tmp", VolumeSource: apiv1.VolumeSource{EmptyDir: &apiv1.EmptyDirVolumeSource{}}})
+	}
+	serviceAccountName, automountServiceAccountToken := getServiceAccount(scmWorkflowDetails.Workflow.WorkflowYaml.Workflow.Kubernetes)
+	backoffLimit := scmWorkflowDetails.Workflow.JobLimits.BackoffLimit
+	ttlSecondsAfterFinished := scmWorkflowDetails.Workflow.JobLimits.TTLSecondsAfterFinished
+	activeDeadlineSeconds := scmWorkflowDetails.Workflow.JobLimits.ActiveDeadlineSeconds
+	labels := getJobLabels(scmWorkflowDetails, jobName)
+	annotations := getJobAnnotations(scmWorkflowDetails)
+	createdAt := time.Now().UTC()
+	annotations["agnops/created-at"] = createdAt.Format(time.RFC3339Nano)
+
 	job := &batchv1.Job{
 		ObjectMeta: metav1.ObjectMeta{
-			Name: jobName,
-			Namespace: namespace,
+			Name:        jobName,
+			Namespace:   namespace,
+			Labels:      labels,
+			Annotations: annotations,
 		},
 		Spec: batchv1.JobSpec{
 			Template: apiv1.PodTemplateSpec{
-				ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"job_name": jobName, "agnops": "job"}},
+				ObjectMeta: metav1.ObjectMeta{Labels: getPodLabels(labels, jobName), Annotations: podAnnotations},
 				Spec: apiv1.PodSpec{
-					Containers: containers,
-					InitContainers: []apiv1.Container{
-						{
-							Name:  "job-helper-init",
-							Image: "agnops/job-helper",
-							ImagePullPolicy: "Always",
-							VolumeMounts: []apiv1.VolumeMount{{MountPath: "/data", Name: "containers-data"}},
-							Env: initContainerEnvs,
-						},
-					},
-					RestartPolicy: "Never",
-					NodeSelector: map[string]string{"nodegroup-type": "cicd-workloads"},
-					Volumes: []apiv1.Volume{cdVolume, dockerSockVolume, dockerDaemonJsonVolume},
+					Containers:                   containers,
+					InitContainers:               initContainers,
+					ImagePullSecrets:             getImagePullSecrets(scmWorkflowDetails.Workflow.WorkflowYaml.Workflow.Kubernetes),
+					SecurityContext:              getPodSecurityContext(),
+					ServiceAccountName:           serviceAccountName,
+					AutomountServiceAccountToken: automountServiceAccountToken,
+					RestartPolicy:                "Never",
+					NodeSelector:                 scmWorkflowDetails.Workflow.JobPlacement.NodeSelector,
+					Tolerations:                  scmWorkflowDetails.Workflow.JobPlacement.Tolerations,
+					Affinity:                     scmWorkflowDetails.Workflow.JobPlacement.Affinity,
+					Volumes:                      volumes,
 				},
 			},
-			BackoffLimit: &backoffLimit,
+			BackoffLimit:            &backoffLimit,
 			TTLSecondsAfterFinished: &ttlSecondsAfterFinished,
+			ActiveDeadlineSeconds:   &activeDeadlineSeconds,
 		},
 	}
 
+	if isJobQueueEnabled() {
+		runRecord := newRunRecord(scmWorkflowDetails, jobName)
+		runRecord.Status = JobQueued
+		if err := createRunRecord(runRecord, scmWorkflowDetails); err != nil {
+			// The run was already queued, by a redelivered webhook for instance
+			if errors.IsAlreadyExists(err) {
+				log.Println(err.Error())
+				return nil
+			}
+			failOnError(err, "Failed to create the run record of job "+jobName)
+			return err
+		}
+		if err := enqueueJob(job, getJobPriority(scmWorkflowDetails)); err != nil {
+			failOnError(err, "Failed on job queueing")
+			recordJobCreationFailure(jobName, "the job could not be queued: "+err.Error())
+			return err
+		}
+		cancelSupersededJobs(scmWorkflowDetails, createdAt)
+		scheduleQueuedJobs()
+		return nil
+	}
+
+	// The record exists before the job, so the job watch always has a run to update
+	err := createRunRecord(newRunRecord(scmWorkflowDetails, jobName), scmWorkflowDetails)
+	if err != nil && !errors.IsAlreadyExists(err) {
+		failOnError(err, "Failed to create the run record of job "+jobName)
+		return err
+	}
+
 	jobsClient := clientset.BatchV1().Jobs(namespace)
 	log.Println("Creating job... ")
 	result1, err := jobsClient.Create(context.TODO(), job, metav1.CreateOptions{})
@@ -192,14 +410,19 @@ func createJobObject(scmWorkflowDetails *ScmWorkflowDetails, jobId int) {
 			log.Println(err.Error())
 		} else {
 			failOnError(err, "Failed on job creation")
+			recordJobCreationFailure(jobName, "the job could not be created: "+err.Error())
+			return err
 		}
+	} else {
+		cancelSupersededJobs(scmWorkflowDetails, createdAt)
 	}
 	log.Printf("Created job %q.\n", result1)
+	return nil
 }
 
-func createConfigMap(scmWorkflowDetails *ScmWorkflowDetails, jobId int) {
+func createConfigMap(scmWorkflowDetails *ScmWorkflowDetails) {
 
-	configMapName := getJobName(scmWorkflowDetails, jobId)
+	configMapName := getJobName(scmWorkflowDetails)
 
 	configMapSpec := apiv1.ConfigMap{
 		TypeMeta: metav1.TypeMeta{
@@ -210,19 +433,22 @@ func createConfigMap(scmWorkflowDetails *ScmWorkflowDetails, jobId int) {
 			Name:      configMapName,
 			Namespace: namespace,
 			Labels: map[string]string{
-				"AgnOps":      "invalidWorkflow",
+				"AgnOps": "invalidWorkflow",
 			},
 		},
 		Data: map[string]string{
-			"CloneURL":		scmWorkflowDetails.CloneURL,
-			"Branch":		scmWorkflowDetails.Branch,
-			"CommitMsg":	scmWorkflowDetails.CommitMsg,
-			"CommitId":		scmWorkflowDetails.CommitId,
-			"CommitUrl":	scmWorkflowDetails.CommitUrl,
-			"Email":		scmWorkflowDetails.Email,
-			"FileName":		scmWorkflowDetails.Workflow.FileName,
+			"CloneURL":  scmWorkflowDetails.CloneURL,
+			"Branch":    scmWorkflowDetails.Branch,
+			"CommitMsg": scmWorkflowDetails.CommitMsg,
+			"CommitId":  scmWorkflowDetails.CommitId,
+			"CommitUrl": scmWorkflowDetails.CommitUrl,
+			"Email":     scmWorkflowDetails.Email,
+			"FileName":  scmWorkflowDetails.Workflow.FileName,
 		},
 	}
+	if len(scmWorkflowDetails.Workflow.Error) > 0 {
+		configMapSpec.Data["Error"] = scmWorkflowDetails.Workflow.Error
+	}
 
 	_, err := configMapClient.Create(context.TODO(), &configMapSpec, metav1.CreateOptions{})
 	if err != nil {
@@ -239,7 +465,7 @@ func initK8sClientset() {
 	config, err = rest.InClusterConfig()
 
 	if err != nil {
-		if  strings.Contains(err.Error(), "unable to load in-cluster configuration") {
+		if strings.Contains(err.Error(), "unable to load in-cluster configuration") {
 			var kubeconfig *string
 			if home := homeDir(); home != "" {
 				kubeconfig = flag.String("kubeconfig", filepath.Join(home, ".kube", "config"), "(optional) absolute path to the kubeconfig file")
@@ -259,9 +485,20 @@ func initK8sClientset() {
 	configMapClient = clientset.CoreV1().ConfigMaps(namespace)
 }
 
+// Fails the run record of a job which could not be created or queued, so it does not stay queued or pending
+func recordJobCreationFailure(jobName string, reason string) {
+	err := updateRunRecord(jobName, func(runRecord *RunRecord) {
+		now := time.Now().UTC()
+		runRecord.Status = JobFailed
+		runRecord.FinishedAt = &now
+		runRecord.Reason = reason
+	})
+	failOnError(err, "Failed to record the job creation failure of run "+jobName)
+}
+
 func homeDir() string {
 	if h := os.Getenv("HOME"); h != "" {
 		return h
 	}
 	return os.Getenv("USERPROFILE") // windows
-}
\ No newline at end of file
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestGetJobName(t *testing.T) {
+	getDetails := func(update func(details *ScmWorkflowDetails)) *ScmWorkflowDetails {
+		details := &ScmWorkflowDetails{
+			ScProvider:    "GitHub",
+			GitOrgProject: "agnops",
+			GitRepository: "job-generator",
+			Branch:        "master",
+			CommitId:      "0123456789abcdef",
+			Workflow:      Workflow{FileName: "build.yaml"},
+		}
+		if update != nil {
+			update(details)
+		}
+		return details
+	}
+
+	base := getJobName(getDetails(nil))
+	if base != getJobName(getDetails(nil)) {
+		t.Fatalf("the job name of a run changes")
+	}
+	if !strings.HasPrefix(base, "agnops-job-generator-master-build-") {
+		t.Errorf("job name %q does not start with the org, repository, branch and workflow", base)
+	}
+	if getJobName(getDetails(func(details *ScmWorkflowDetails) { details.Attempt = 1 })) != base {
+		t.Errorf("the first attempt does not keep the job name")
+	}
+
+	variants := map[string]func(details *ScmWorkflowDetails){
+		"provider":           func(details *ScmWorkflowDetails) { details.ScProvider = "GitLab" },
+		"commit":             func(details *ScmWorkflowDetails) { details.CommitId = "fedcba9876543210" },
+		"workflow directory": func(details *ScmWorkflowDetails) { details.Workflow.FileName = "ci/build.yaml" },
+		"workflow extension": func(details *ScmWorkflowDetails) { details.Workflow.FileName = "build.yml" },
+		"matrix combination": func(details *ScmWorkflowDetails) { details.Matrix = map[string]string{"go": "1.14"} },
+		"other combination":  func(details *ScmWorkflowDetails) { details.Matrix = map[string]string{"go": "1.15"} },
+		"attempt":            func(details *ScmWorkflowDetails) { details.Attempt = 2 },
+		"same sanitized prefix": func(details *ScmWorkflowDetails) {
+			details.GitOrgProject = "agnops-job"
+			details.GitRepository = "generator"
+		},
+	}
+	names := map[string]string{base: "base"}
+	for variant, update := range variants {
+		name := getJobName(getDetails(update))
+		if other, ok := names[name]; ok {
+			t.Errorf("%s and %s share the job name %s", variant, other, name)
+		}
+		names[name] = variant
+	}
+
+	dnsLabel := regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
+	for _, details := range []*ScmWorkflowDetails{
+		getDetails(func(details *ScmWorkflowDetails) { details.Branch = strings.Repeat("feature/", 20) }),
+		getDetails(func(details *ScmWorkflowDetails) { details.GitOrgProject = "Org_With.Dots"; details.Branch = "-" }),
+		getDetails(func(details *ScmWorkflowDetails) {
+			details.GitOrgProject, details.GitRepository, details.Branch, details.Workflow.FileName = "_", "_", "_", "_.yaml"
+		}),
+	} {
+		name := getJobName(details)
+		if len(name) > 63 || !dnsLabel.MatchString(name) {
+			t.Errorf("job name %q is not a valid label of at most 63 characters", name)
+		}
+	}
+}
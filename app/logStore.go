@@ -0,0 +1,54 @@
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// Storage of the archived container logs, selected with LOG_STORE
+type LogStore interface {
+	Create(runId string, container string) (io.WriteCloser, error)
+	Open(runId string, container string) (io.ReadCloser, error)
+	Delete(runId string) error
+}
+
+var logStore = getLogStore()
+
+func getLogStore() LogStore {
+	switch os.Getenv("LOG_STORE") {
+	case "", "filesystem":
+		root := os.Getenv("LOG_STORE_PATH")
+		if root == "" {
+			root = "/var/lib/agnops/logs"
+		}
+		return &fileSystemLogStore{root: root}
+	default:
+		log.Printf("Unknown LOG_STORE %s, using the filesystem\n", os.Getenv("LOG_STORE"))
+		return &fileSystemLogStore{root: "/var/lib/agnops/logs"}
+	}
+}
+
+type fileSystemLogStore struct {
+	root string
+}
+
+func (store *fileSystemLogStore) getPath(runId string, container string) string {
+	return filepath.Join(store.root, runId, container+".log.gz")
+}
+
+func (store *fileSystemLogStore) Create(runId string, container string) (io.WriteCloser, error) {
+	if err := os.MkdirAll(filepath.Join(store.root, runId), 0755); err != nil {
+		return nil, err
+	}
+	return os.Create(store.getPath(runId, container))
+}
+
+func (store *fileSystemLogStore) Open(runId string, container string) (io.ReadCloser, error) {
+	return os.Open(store.getPath(runId, container))
+}
+
+func (store *fileSystemLogStore) Delete(runId string) error {
+	return os.RemoveAll(filepath.Join(store.root, runId))
+}
@@ -1,13 +1,16 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
 	"reflect"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gorilla/handlers"
 	"gopkg.in/go-playground/webhooks.v5/github"
@@ -17,6 +20,29 @@ import (
 var scmProvider = os.Getenv("scmProvider")
 var cloudName = os.Getenv("cloudName")
 
+func getEnvInt(name string, defaultValue int) int {
+	value, err := strconv.Atoi(os.Getenv(name))
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
+
+func getEnvString(name string, defaultValue string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+func getEnvDuration(name string, defaultValue time.Duration) time.Duration {
+	value, err := time.ParseDuration(os.Getenv(name))
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
+
 func HealthCheckHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	w.Header().Set("Content-Type", "application/json")
@@ -30,6 +56,138 @@ func getScmWebhookSecret() string {
 	return getWebhookSecret(secretName)
 }
 
+func getTagName(ref string) string {
+	if strings.HasPrefix(ref, "refs/tags/") {
+		return strings.Replace(ref, "refs/tags/", "", 1)
+	}
+	return ""
+}
+
+func getPushEventName(ref string) string {
+	if getTagName(ref) != "" {
+		return "tag"
+	}
+	return "push"
+}
+
+// Creates the jobs of a workflow and returns how many were created. Invalid workflows are recorded as ConfigMaps
+func generateWorkflowJob(scmWorkflowDetails *ScmWorkflowDetails) (int, error) {
+	if reflect.DeepEqual(WorkflowYaml{}, scmWorkflowDetails.Workflow.WorkflowYaml) {
+		createConfigMap(scmWorkflowDetails)
+		return 0, fmt.Errorf("invalid workflow file %s: %s", scmWorkflowDetails.Workflow.FileName, scmWorkflowDetails.Workflow.Error)
+	}
+
+	matrixCells, err := expandMatrix(scmWorkflowDetails.Workflow.WorkflowYaml.Workflow.Matrix)
+	if err != nil {
+		failOnError(err, "Failed to expand the matrix of the workflow file: "+scmWorkflowDetails.Workflow.FileName)
+		scmWorkflowDetails.Workflow.Error = err.Error()
+		createConfigMap(scmWorkflowDetails)
+		return 0, err
+	}
+	// A workflow without a matrix runs once, without matrix values
+	if matrixCells == nil {
+		matrixCells = []map[string]string{nil}
+	}
+
+	// Every combination is interpolated before any job is created, so an invalid workflow creates no job at all
+	var cellsWorkflowDetails []*ScmWorkflowDetails
+	var skippedCellsWorkflowDetails []*ScmWorkflowDetails
+	for _, matrixCell := range matrixCells {
+		cellWorkflowDetails := *scmWorkflowDetails
+		cellWorkflowDetails.Matrix = matrixCell
+		if err := interpolateWorkflow(&cellWorkflowDetails); err != nil {
+			failOnError(err, "Failed to interpolate the workflow file: "+scmWorkflowDetails.Workflow.FileName)
+			scmWorkflowDetails.Workflow.Error = err.Error()
+			createConfigMap(scmWorkflowDetails)
+			return 0, err
+		}
+		jobLimits, err := getJobLimits(cellWorkflowDetails.Workflow.WorkflowYaml.Workflow.Kubernetes)
+		if err != nil {
+			failOnError(err, "Invalid kubernetes section in the workflow file: "+scmWorkflowDetails.Workflow.FileName)
+			scmWorkflowDetails.Workflow.Error = err.Error()
+			createConfigMap(scmWorkflowDetails)
+			return 0, err
+		}
+		cellWorkflowDetails.Workflow.JobLimits = jobLimits
+		jobPlacement, err := getJobPlacement(cellWorkflowDetails.Workflow.WorkflowYaml.Workflow.Kubernetes)
+		if err != nil {
+			failOnError(err, "Invalid kubernetes section in the workflow file: "+scmWorkflowDetails.Workflow.FileName)
+			scmWorkflowDetails.Workflow.Error = err.Error()
+			createConfigMap(scmWorkflowDetails)
+			return 0, err
+		}
+		cellWorkflowDetails.Workflow.JobPlacement = jobPlacement
+		if err := selectWorkflowContainers(&cellWorkflowDetails); err != nil {
+			failOnError(err, "Failed to resolve the containers of the workflow file: "+scmWorkflowDetails.Workflow.FileName)
+			scmWorkflowDetails.Workflow.Error = err.Error()
+			createConfigMap(scmWorkflowDetails)
+			return 0, err
+		}
+		if len(cellWorkflowDetails.Workflow.WorkflowYaml.Workflow.Containers) == 0 {
+			log.Printf("Skipping workflow %s, all of its containers were skipped\n", scmWorkflowDetails.Workflow.FileName)
+			skippedCellsWorkflowDetails = append(skippedCellsWorkflowDetails, &cellWorkflowDetails)
+			continue
+		}
+		cellsWorkflowDetails = append(cellsWorkflowDetails, &cellWorkflowDetails)
+	}
+
+	for _, cellWorkflowDetails := range skippedCellsWorkflowDetails {
+		recordSkippedRun(cellWorkflowDetails)
+	}
+
+	jobsCount := 0
+	for _, cellWorkflowDetails := range cellsWorkflowDetails {
+		if err := createJobObject(cellWorkflowDetails); err != nil {
+			return jobsCount, err
+		}
+		jobsCount++
+	}
+	return jobsCount, nil
+}
+
+type WebhookCommitResult struct {
+	CommitId         string            `json:"commitId"`
+	Skipped          bool              `json:"skipped"`
+	Reason           string            `json:"reason,omitempty"`
+	Workflows        []string          `json:"workflows,omitempty"`
+	SkippedWorkflows map[string]string `json:"skippedWorkflows,omitempty"`
+}
+
+func writeWebhookResponse(w http.ResponseWriter, commitResults []WebhookCommitResult) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{"commits": commitResults})
+}
+
+// Returns the result of a commit skipped by a skip CI marker of its message, or nil
+func checkSkipCi(commitId string, commitMsg string) *WebhookCommitResult {
+	marker := getSkipCiMarker(commitMsg)
+	if marker == "" {
+		return nil
+	}
+	log.Printf("Skipping commit %s, its message contains %s\n", commitId, marker)
+	return &WebhookCommitResult{CommitId: commitId, Skipped: true, Reason: "commit message contains " + marker}
+}
+
+// Drops the workflows filtering out the commit author, then dispatches the others
+func dispatchCommitWorkflows(workflowsDetails []*ScmWorkflowDetails, commitResult *WebhookCommitResult) {
+	var authorWorkflowsDetails []*ScmWorkflowDetails
+	for _, scmWorkflowDetails := range workflowsDetails {
+		workflowYaml := scmWorkflowDetails.Workflow.WorkflowYaml.Workflow
+		if reason := checkAuthorFilters(workflowYaml.AuthorFilters, workflowYaml.IgnoreAuthors, scmWorkflowDetails.Email); reason != "" {
+			log.Printf("Skipping workflow %s for commit %s: %s\n", scmWorkflowDetails.Workflow.FileName, scmWorkflowDetails.CommitId, reason)
+			if commitResult.SkippedWorkflows == nil {
+				commitResult.SkippedWorkflows = map[string]string{}
+			}
+			commitResult.SkippedWorkflows[scmWorkflowDetails.Workflow.FileName] = reason
+			continue
+		}
+		commitResult.Workflows = append(commitResult.Workflows, scmWorkflowDetails.Workflow.FileName)
+		authorWorkflowsDetails = append(authorWorkflowsDetails, scmWorkflowDetails)
+	}
+	dispatchWorkflows(authorWorkflowsDetails)
+}
+
 func GitHubWebhooks(w http.ResponseWriter, r *http.Request) {
 
 	hook, _ := github.New(github.Options.Secret(getScmWebhookSecret()))
@@ -40,6 +198,9 @@ func GitHubWebhooks(w http.ResponseWriter, r *http.Request) {
 			// ok event wasn;t one of the ones asked to be parsed
 		}
 	}
+	commitResults := []WebhookCommitResult{}
+	defer func() { writeWebhookResponse(w, commitResults) }()
+
 	switch payload.(type) {
 
 	case github.PullRequestPayload:
@@ -55,6 +216,11 @@ func GitHubWebhooks(w http.ResponseWriter, r *http.Request) {
 
 		for _, commit := range pushPl.Commits {
 
+			if skippedCommit := checkSkipCi(commit.ID, commit.Message); skippedCommit != nil {
+				commitResults = append(commitResults, *skippedCommit)
+				continue
+			}
+
 			changedFiles := append(commit.Added, commit.Modified...)
 			branch := strings.Replace(pushPl.Ref, "refs/heads/", "", -1)
 			workflows, err := checkGitWorkflowExistInRepo(pushPl.Repository.CloneURL, orgOrUserName, gitRepository, pushPl.HeadCommit.ID, oauthToken, "x-oauth-basic", changedFiles, branch)
@@ -63,7 +229,8 @@ func GitHubWebhooks(w http.ResponseWriter, r *http.Request) {
 
 			if err == nil && len(workflows) > 0 {
 
-				for i, workflow := range workflows {
+				var workflowsDetails []*ScmWorkflowDetails
+				for _, workflow := range workflows {
 					scmWorkflowDetails := &ScmWorkflowDetails{
 						ScProvider:    "GitHub",
 						GitOrgProject: orgOrUserName,
@@ -71,18 +238,20 @@ func GitHubWebhooks(w http.ResponseWriter, r *http.Request) {
 						OAuthToken:    oauthToken,
 						CloneURL:      pushPl.Repository.CloneURL,
 						Branch:        branch,
+						Tag:           getTagName(pushPl.Ref),
+						Event:         getPushEventName(pushPl.Ref),
+						ChangedFiles:  changedFiles,
 						CommitId:      commit.ID,
 						CommitMsg:     commit.Message,
 						CommitUrl:     commit.URL,
 						Email:         commit.Author.Email,
 						Workflow:      workflow,
 					}
-					if !reflect.DeepEqual(WorkflowYaml{}, workflow.WorkflowYaml) {
-						createJobObject(scmWorkflowDetails, i)
-					} else {
-						createConfigMap(scmWorkflowDetails, i)
-					}
+					workflowsDetails = append(workflowsDetails, scmWorkflowDetails)
 				}
+				commitResult := WebhookCommitResult{CommitId: commit.ID}
+				dispatchCommitWorkflows(workflowsDetails, &commitResult)
+				commitResults = append(commitResults, commitResult)
 			}
 		}
 	}
@@ -98,18 +267,29 @@ func GitLabWebhooks(w http.ResponseWriter, r *http.Request) {
 			log.Println("ok event wasn`t one of the ones asked to be parsed")
 		}
 	}
+	commitResults := []WebhookCommitResult{}
+	defer func() { writeWebhookResponse(w, commitResults) }()
+
 	switch payload.(type) {
 
 	case gitlab.PushEventPayload:
 		log.Println("PushEventPayload")
 		pushPl := payload.(gitlab.PushEventPayload)
 
-		orgOrUserName := pushPl.UserUsername
-		gitRepository := pushPl.Repository.Name
-		oauthToken, _ := GetUserOrOrganizationToken(scmProvider, orgOrUserName)
+		// The namespace of the project, not the pusher, owns the repository and scopes the allowlists
+		orgOrUserName, gitRepository := getGitLabProjectPath(pushPl.Project.PathWithNamespace)
+		oauthToken, err := GetUserOrOrganizationToken(scmProvider, orgOrUserName)
+		if err != nil {
+			oauthToken, _ = GetUserOrOrganizationToken(scmProvider, pushPl.UserUsername)
+		}
 
 		for _, commit := range pushPl.Commits {
 
+			if skippedCommit := checkSkipCi(commit.ID, commit.Message); skippedCommit != nil {
+				commitResults = append(commitResults, *skippedCommit)
+				continue
+			}
+
 			changedFiles := append(commit.Added, commit.Modified...)
 			branch := strings.Replace(pushPl.Ref, "refs/heads/", "", -1)
 			workflows, err := checkGitWorkflowExistInRepo(pushPl.Project.GitHTTPURL, orgOrUserName, gitRepository, commit.ID, oauthToken, "oauth2", changedFiles, branch)
@@ -118,36 +298,65 @@ func GitLabWebhooks(w http.ResponseWriter, r *http.Request) {
 
 			if err == nil && len(workflows) > 0 {
 
-				for i, workflow := range workflows {
+				var workflowsDetails []*ScmWorkflowDetails
+				for _, workflow := range workflows {
 
 					scmWorkflowDetails := &ScmWorkflowDetails{
 						ScProvider:    "GitLab",
 						GitOrgProject: orgOrUserName,
 						GitRepository: gitRepository,
+						ProjectId:     strconv.FormatInt(pushPl.ProjectID, 10),
 						OAuthToken:    oauthToken,
 						CloneURL:      pushPl.Project.GitHTTPURL,
 						Branch:        branch,
+						Tag:           getTagName(pushPl.Ref),
+						Event:         getPushEventName(pushPl.Ref),
+						ChangedFiles:  changedFiles,
 						CommitId:      commit.ID,
 						CommitMsg:     commit.Message,
 						CommitUrl:     commit.URL,
 						Email:         commit.Author.Email,
 						Workflow:      workflow,
 					}
-					if !reflect.DeepEqual(WorkflowYaml{}, workflow.WorkflowYaml) {
-						createJobObject(scmWorkflowDetails, i)
-					} else {
-						createConfigMap(scmWorkflowDetails, i)
-					}
+					workflowsDetails = append(workflowsDetails, scmWorkflowDetails)
 				}
+				commitResult := WebhookCommitResult{CommitId: commit.ID}
+				dispatchCommitWorkflows(workflowsDetails, &commitResult)
+				commitResults = append(commitResults, commitResult)
 			}
 		}
 	}
 }
 
+// Splits the path of a GitLab project, group/subgroup/project, into its namespace and project path
+func getGitLabProjectPath(pathWithNamespace string) (string, string) {
+	i := strings.LastIndex(pathWithNamespace, "/")
+	if i < 0 {
+		return "", pathWithNamespace
+	}
+	return pathWithNamespace[:i], pathWithNamespace[i+1:]
+}
+
 func main() {
 
+	if err := checkImagePullPolicy(defaultImagePullPolicy); err != nil {
+		log.Fatalf("Invalid IMAGE_PULL_POLICY: %s", err)
+	}
 	initK8sClientset()
 
+	onJobStateChange(handleNeedsJobState)
+	onJobStateChange(queueJobCommitStatus)
+	onJobStateChange(recordJobState)
+	onJobStateChange(releaseJobSlot)
+	go reportCommitStatuses()
+	// Restored before the watch starts, so the jobs which finished meanwhile are reported to the restored groups
+	restoreDependencyGroups()
+	go timeOutDependencyGroups()
+	go watchJobs()
+	go watchJobPods()
+	go pruneRunRecords()
+	go runJobQueue()
+
 	switch scmProvider {
 	case "github":
 		http.HandleFunc("/webhooks", GitHubWebhooks)
@@ -156,6 +365,10 @@ func main() {
 	}
 
 	http.HandleFunc("/healthcheck", HealthCheckHandler)
+	http.HandleFunc("/api/runs", RunsHandler)
+	http.HandleFunc("/api/runs/", RunHandler)
+	http.HandleFunc("/api/queue", QueueHandler)
+	http.HandleFunc("/api/artifacts", ArtifactsHandler)
 
 	http.ListenAndServe(":3000", handlers.LoggingHandler(os.Stdout, http.DefaultServeMux))
 }
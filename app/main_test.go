@@ -0,0 +1,21 @@
+package main
+
+import "testing"
+
+func TestGetGitLabProjectPath(t *testing.T) {
+	tests := []struct {
+		pathWithNamespace string
+		namespace         string
+		project           string
+	}{
+		{pathWithNamespace: "agnops/job-generator", namespace: "agnops", project: "job-generator"},
+		{pathWithNamespace: "agnops/tools/job-generator", namespace: "agnops/tools", project: "job-generator"},
+		{pathWithNamespace: "job-generator", namespace: "", project: "job-generator"},
+	}
+	for _, test := range tests {
+		namespace, project := getGitLabProjectPath(test.pathWithNamespace)
+		if namespace != test.namespace || project != test.project {
+			t.Errorf("getGitLabProjectPath(%q) = %q, %q, want %q, %q", test.pathWithNamespace, namespace, project, test.namespace, test.project)
+		}
+	}
+}
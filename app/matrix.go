@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+var maxMatrixSize = getEnvInt("MAX_MATRIX_SIZE", 64)
+
+// Matrix axes are declared as lists of values, next to the optional include/exclude combinations:
+//
+//	matrix:
+//	  go: ["1.13", "1.14"]
+//	  arch: [amd64, arm64]
+//	  exclude:
+//	    - go: "1.13"
+//	      arch: arm64
+type Matrix struct {
+	Axes    map[string][]string
+	Include []map[string]string
+	Exclude []map[string]string
+}
+
+func (matrix *Matrix) UnmarshalYAML(value *yaml.Node) error {
+	var raw map[string]yaml.Node
+	if err := value.Decode(&raw); err != nil {
+		return err
+	}
+
+	for key, node := range raw {
+		var err error
+		switch key {
+		case "include":
+			err = node.Decode(&matrix.Include)
+		case "exclude":
+			err = node.Decode(&matrix.Exclude)
+		default:
+			var values []string
+			err = node.Decode(&values)
+			if matrix.Axes == nil {
+				matrix.Axes = map[string][]string{}
+			}
+			matrix.Axes[key] = values
+		}
+		if err != nil {
+			return fmt.Errorf("matrix.%s: %s", key, err)
+		}
+	}
+	return nil
+}
+
+func matchMatrixCell(cell map[string]string, entry map[string]string) bool {
+	for key, value := range entry {
+		if cellValue, ok := cell[key]; !ok || cellValue != value {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the combinations of the matrix in a deterministic order, or nil when the workflow has no matrix. A declared
+// matrix without any combination, because of an empty axis or excluded combinations, is an error
+func expandMatrix(matrix Matrix) ([]map[string]string, error) {
+	axisNames := make([]string, 0, len(matrix.Axes))
+	size := 1
+	for name, values := range matrix.Axes {
+		axisNames = append(axisNames, name)
+		size *= len(values)
+		if size > maxMatrixSize {
+			return nil, fmt.Errorf("matrix exceeds the maximum of %d combinations", maxMatrixSize)
+		}
+	}
+	sort.Strings(axisNames)
+
+	var cells []map[string]string
+	if len(axisNames) > 0 {
+		cells = []map[string]string{{}}
+	}
+	for _, name := range axisNames {
+		var expanded []map[string]string
+		for _, cell := range cells {
+			for _, value := range matrix.Axes[name] {
+				expandedCell := map[string]string{name: value}
+				for k, v := range cell {
+					expandedCell[k] = v
+				}
+				expanded = append(expanded, expandedCell)
+			}
+		}
+		cells = expanded
+	}
+
+	var included []map[string]string
+	for _, cell := range cells {
+		excluded := false
+		for _, exclude := range matrix.Exclude {
+			if matchMatrixCell(cell, exclude) {
+				excluded = true
+				break
+			}
+		}
+		if !excluded {
+			included = append(included, cell)
+		}
+	}
+
+	// An include entry extends the combinations matching its axis values, otherwise it is added as a new combination
+	for _, include := range matrix.Include {
+		axisValues := map[string]string{}
+		for key, value := range include {
+			if _, ok := matrix.Axes[key]; ok {
+				axisValues[key] = value
+			}
+		}
+		extended := false
+		for _, cell := range included {
+			if len(axisValues) > 0 && matchMatrixCell(cell, axisValues) {
+				for key, value := range include {
+					cell[key] = value
+				}
+				extended = true
+			}
+		}
+		if !extended {
+			cell := map[string]string{}
+			for key, value := range include {
+				cell[key] = value
+			}
+			included = append(included, cell)
+		}
+	}
+
+	if len(included) > maxMatrixSize {
+		return nil, fmt.Errorf("matrix exceeds the maximum of %d combinations", maxMatrixSize)
+	}
+	declared := len(matrix.Axes) > 0 || len(matrix.Include) > 0 || len(matrix.Exclude) > 0
+	if declared && len(included) == 0 {
+		return nil, fmt.Errorf("matrix has no combination, an axis is empty or every combination is excluded")
+	}
+	return included, nil
+}
+
+// Short deterministic identifier of a matrix combination, used to keep job names unique per combination
+func getMatrixCellId(cell map[string]string) string {
+	if len(cell) == 0 {
+		return ""
+	}
+	hash := sha1.New()
+	for _, key := range getSortedKeys(cell) {
+		fmt.Fprintf(hash, "%s=%s\n", key, cell[key])
+	}
+	return hex.EncodeToString(hash.Sum(nil))[:6]
+}
+
+func getSortedKeys(values map[string]string) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Readable form of a matrix combination, such as "arch=amd64, go=1.13"
+func getMatrixDescription(cell map[string]string) string {
+	var values []string
+	for _, key := range getSortedKeys(cell) {
+		values = append(values, key+"="+cell[key])
+	}
+	return strings.Join(values, ", ")
+}
+
+func getMatrixEnvName(key string) string {
+	return "MATRIX_" + regexp.MustCompile(`[^A-Z0-9_]`).ReplaceAllString(strings.ToUpper(key), "_")
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExpandMatrix(t *testing.T) {
+	tests := []struct {
+		name    string
+		matrix  Matrix
+		want    []map[string]string
+		wantErr bool
+	}{
+		{
+			name:   "no matrix",
+			matrix: Matrix{},
+			want:   nil,
+		},
+		{
+			name:   "single axis",
+			matrix: Matrix{Axes: map[string][]string{"go": {"1.13", "1.14"}}},
+			want:   []map[string]string{{"go": "1.13"}, {"go": "1.14"}},
+		},
+		{
+			name:   "axes expanded in name order",
+			matrix: Matrix{Axes: map[string][]string{"go": {"1.13", "1.14"}, "arch": {"amd64", "arm64"}}},
+			want: []map[string]string{
+				{"arch": "amd64", "go": "1.13"},
+				{"arch": "amd64", "go": "1.14"},
+				{"arch": "arm64", "go": "1.13"},
+				{"arch": "arm64", "go": "1.14"},
+			},
+		},
+		{
+			name: "exclude",
+			matrix: Matrix{
+				Axes:    map[string][]string{"go": {"1.13", "1.14"}, "arch": {"amd64", "arm64"}},
+				Exclude: []map[string]string{{"go": "1.13", "arch": "arm64"}},
+			},
+			want: []map[string]string{
+				{"arch": "amd64", "go": "1.13"},
+				{"arch": "amd64", "go": "1.14"},
+				{"arch": "arm64", "go": "1.14"},
+			},
+		},
+		{
+			name: "include extends the matching combinations",
+			matrix: Matrix{
+				Axes:    map[string][]string{"go": {"1.13", "1.14"}},
+				Include: []map[string]string{{"go": "1.14", "experimental": "true"}},
+			},
+			want: []map[string]string{{"go": "1.13"}, {"go": "1.14", "experimental": "true"}},
+		},
+		{
+			name: "include adds a combination",
+			matrix: Matrix{
+				Axes:    map[string][]string{"go": {"1.13"}},
+				Include: []map[string]string{{"go": "1.15"}},
+			},
+			want: []map[string]string{{"go": "1.13"}, {"go": "1.15"}},
+		},
+		{
+			name:   "include only",
+			matrix: Matrix{Include: []map[string]string{{"os": "linux"}}},
+			want:   []map[string]string{{"os": "linux"}},
+		},
+		{
+			name:    "empty axis",
+			matrix:  Matrix{Axes: map[string][]string{"go": {}}},
+			wantErr: true,
+		},
+		{
+			name: "every combination excluded",
+			matrix: Matrix{
+				Axes:    map[string][]string{"go": {"1.13"}},
+				Exclude: []map[string]string{{"go": "1.13"}},
+			},
+			wantErr: true,
+		},
+		{
+			name:    "too many combinations",
+			matrix:  Matrix{Axes: map[string][]string{"a": make([]string, 10), "b": make([]string, 10)}},
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cells, err := expandMatrix(test.matrix)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", cells)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !reflect.DeepEqual(cells, test.want) {
+				t.Errorf("got %v, want %v", cells, test.want)
+			}
+		})
+	}
+}
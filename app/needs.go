@@ -0,0 +1,463 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+type workflowProgress struct {
+	ScmWorkflowDetails *ScmWorkflowDetails
+	Needs              []string
+	// Started once its needs succeeded, Generated once its jobs were created and JobsCount is known
+	Started       bool
+	Generated     bool
+	Failed        bool
+	JobsCount     int
+	SucceededJobs map[string]bool
+}
+
+func (progress *workflowProgress) isSucceeded() bool {
+	return progress.Generated && !progress.Failed && len(progress.SucceededJobs) >= progress.JobsCount
+}
+
+// The workflows triggered by one commit, in the order of their files
+type dependencyGroup struct {
+	Workflows map[string]*workflowProgress
+	Order     []string
+	CreatedAt time.Time
+}
+
+// The workflows still waiting on their needs after NEEDS_TIMEOUT are cancelled
+var dependencyGroupTimeout = getEnvDuration("NEEDS_TIMEOUT", 24*time.Hour)
+
+// Groups with workflows still waiting on their needs. They are persisted in Secrets labeled AgnOps: needs, as the
+// workflow details hold the OAuth token, and restored on start. API calls are made without holding
+// dependencyGroupsMutex, dependencyGroupsSaveMutex keeps the saves of a group in order
+var dependencyGroups = map[string]*dependencyGroup{}
+var dependencyGroupsMutex sync.Mutex
+var dependencyGroupsSaveMutex sync.Mutex
+
+func getDependencyGroup(scmWorkflowDetails *ScmWorkflowDetails) string {
+	return fmt.Sprintf("%s/%s@%s", scmWorkflowDetails.GitOrgProject, scmWorkflowDetails.GitRepository, scmWorkflowDetails.CommitId)
+}
+
+func getDependencyGroupSecretName(groupName string) string {
+	hash := sha1.Sum([]byte(groupName))
+	return "agnops-needs-" + hex.EncodeToString(hash[:])[:16]
+}
+
+func resolveWorkflowNeed(need string, workflows map[string]*workflowProgress) (string, bool) {
+	if _, ok := workflows[need]; ok {
+		return need, true
+	}
+	if _, ok := workflows[need+".yaml"]; ok {
+		return need + ".yaml", true
+	}
+	return "", false
+}
+
+// Marks the workflow as failed, the caller records it with createConfigMap once dependencyGroupsMutex is released
+func cancelWorkflow(progress *workflowProgress, reason string) {
+	log.Printf("Cancelling workflow %s: %s\n", progress.ScmWorkflowDetails.Workflow.FileName, reason)
+	progress.Started = true
+	progress.Failed = true
+	progress.ScmWorkflowDetails.Workflow.Error = reason
+}
+
+// Returns the workflows of the dependency cycle going through name, nil when it is not part of a cycle
+func findDependencyCycle(group *dependencyGroup, name string, path []string, visited map[string]bool) []string {
+	for _, need := range group.Workflows[name].Needs {
+		if need == path[0] {
+			return append(path, need)
+		}
+		if visited[need] {
+			continue
+		}
+		visited[need] = true
+		if cycle := findDependencyCycle(group, need, append(path, need), visited); cycle != nil {
+			return cycle
+		}
+	}
+	return nil
+}
+
+// Cancels the workflows which can never start. Already cancelled workflows count as resolved, their dependents are
+// cancelled by scheduleWorkflows with the reason of the cancellation
+func rejectDependencyCycles(group *dependencyGroup) []*workflowProgress {
+	resolved := map[string]bool{}
+	for _, name := range group.Order {
+		resolved[name] = group.Workflows[name].Failed
+	}
+	for changed := true; changed; {
+		changed = false
+		for _, name := range group.Order {
+			if resolved[name] {
+				continue
+			}
+			ready := true
+			for _, need := range group.Workflows[name].Needs {
+				if !resolved[need] {
+					ready = false
+					break
+				}
+			}
+			if ready {
+				resolved[name] = true
+				changed = true
+			}
+		}
+	}
+
+	var cancelled []*workflowProgress
+	for _, name := range group.Order {
+		if resolved[name] {
+			continue
+		}
+		progress := group.Workflows[name]
+		if cycle := findDependencyCycle(group, name, []string{name}, map[string]bool{}); cycle != nil {
+			cancelWorkflow(progress, "needs form a dependency cycle: "+strings.Join(cycle, " -> "))
+		} else {
+			for _, need := range progress.Needs {
+				if !resolved[need] {
+					cancelWorkflow(progress, "needed workflow "+need+" depends on a dependency cycle")
+					break
+				}
+			}
+		}
+		cancelled = append(cancelled, progress)
+	}
+	return cancelled
+}
+
+// Picks the workflows whose needs succeeded and cancels the ones with a failed need. The caller holds
+// dependencyGroupsMutex, then creates the jobs of the started workflows and records the cancelled ones
+func scheduleWorkflows(group *dependencyGroup) (started []*workflowProgress, cancelled []*workflowProgress) {
+	for changed := true; changed; {
+		changed = false
+		for _, name := range group.Order {
+			progress := group.Workflows[name]
+			if progress.Started {
+				continue
+			}
+
+			waiting := false
+			failedNeed := ""
+			for _, need := range progress.Needs {
+				if group.Workflows[need].Failed {
+					failedNeed = need
+					break
+				}
+				if !group.Workflows[need].isSucceeded() {
+					waiting = true
+				}
+			}
+			if failedNeed != "" {
+				reason := "needed workflow " + failedNeed + " failed"
+				if needError := group.Workflows[failedNeed].ScmWorkflowDetails.Workflow.Error; needError != "" {
+					reason = "needed workflow " + failedNeed + " was cancelled: " + needError
+				}
+				cancelWorkflow(progress, reason)
+				cancelled = append(cancelled, progress)
+				changed = true
+				continue
+			}
+			if waiting {
+				continue
+			}
+
+			progress.Started = true
+			started = append(started, progress)
+		}
+	}
+	return started, cancelled
+}
+
+func isDependencyGroupDone(group *dependencyGroup) bool {
+	for _, progress := range group.Workflows {
+		if !progress.Failed && !progress.Generated {
+			return false
+		}
+	}
+	return true
+}
+
+// Saves the group, or deletes its Secret once every workflow was created or cancelled
+func persistDependencyGroup(groupName string) {
+	dependencyGroupsSaveMutex.Lock()
+	defer dependencyGroupsSaveMutex.Unlock()
+
+	secretName := getDependencyGroupSecretName(groupName)
+	dependencyGroupsMutex.Lock()
+	group, ok := dependencyGroups[groupName]
+	var content []byte
+	var err error
+	if ok {
+		content, err = json.Marshal(group)
+	}
+	dependencyGroupsMutex.Unlock()
+
+	if !ok {
+		err = secretsClient.Delete(context.TODO(), secretName, metav1.DeleteOptions{})
+		if err != nil && !errors.IsNotFound(err) {
+			failOnError(err, "Failed to delete the dependency group "+groupName)
+		}
+		return
+	}
+	if err != nil {
+		failOnError(err, "Failed to serialize the dependency group "+groupName)
+		return
+	}
+
+	secret, err := secretsClient.Get(context.TODO(), secretName, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		secretSpec := apiv1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        secretName,
+				Namespace:   namespace,
+				Labels:      map[string]string{"AgnOps": "needs"},
+				Annotations: map[string]string{"agnops/dependency-group": groupName},
+			},
+			Data: map[string][]byte{"Group": content},
+			Type: "Opaque",
+		}
+		_, err = secretsClient.Create(context.TODO(), &secretSpec, metav1.CreateOptions{})
+		failOnError(err, "Failed to save the dependency group "+groupName)
+		return
+	}
+	if err != nil {
+		failOnError(err, "Failed to read the dependency group "+groupName)
+		return
+	}
+	secret.Data = map[string][]byte{"Group": content}
+	_, err = secretsClient.Update(context.TODO(), secret, metav1.UpdateOptions{})
+	failOnError(err, "Failed to save the dependency group "+groupName)
+}
+
+// Starts the workflows of the group whose needs succeeded until none is left to start. The jobs are created and the
+// cancelled workflows recorded without holding dependencyGroupsMutex
+func runDependencyGroup(groupName string) {
+	for {
+		dependencyGroupsMutex.Lock()
+		group, ok := dependencyGroups[groupName]
+		if !ok {
+			dependencyGroupsMutex.Unlock()
+			return
+		}
+		started, cancelled := scheduleWorkflows(group)
+		if isDependencyGroupDone(group) {
+			delete(dependencyGroups, groupName)
+		}
+		dependencyGroupsMutex.Unlock()
+
+		persistDependencyGroup(groupName)
+		for _, progress := range cancelled {
+			createConfigMap(progress.ScmWorkflowDetails)
+		}
+		if len(started) == 0 {
+			return
+		}
+
+		for _, progress := range started {
+			jobsCount, err := generateWorkflowJob(progress.ScmWorkflowDetails)
+			dependencyGroupsMutex.Lock()
+			progress.JobsCount = jobsCount
+			progress.Generated = true
+			if err != nil {
+				progress.Failed = true
+			}
+			if _, ok := dependencyGroups[groupName]; ok && isDependencyGroupDone(group) {
+				delete(dependencyGroups, groupName)
+			}
+			dependencyGroupsMutex.Unlock()
+		}
+		persistDependencyGroup(groupName)
+	}
+}
+
+// Creates the jobs of the workflows triggered by one commit, holding back the ones declaring needs
+func dispatchWorkflows(workflowsDetails []*ScmWorkflowDetails) {
+	if len(workflowsDetails) == 0 {
+		return
+	}
+
+	group := &dependencyGroup{Workflows: map[string]*workflowProgress{}, CreatedAt: time.Now().UTC()}
+	for _, scmWorkflowDetails := range workflowsDetails {
+		group.Workflows[scmWorkflowDetails.Workflow.FileName] = &workflowProgress{ScmWorkflowDetails: scmWorkflowDetails, SucceededJobs: map[string]bool{}}
+		group.Order = append(group.Order, scmWorkflowDetails.Workflow.FileName)
+	}
+
+	var cancelled []*workflowProgress
+	for _, name := range group.Order {
+		progress := group.Workflows[name]
+		for _, need := range progress.ScmWorkflowDetails.Workflow.WorkflowYaml.Workflow.Needs {
+			resolvedNeed, ok := resolveWorkflowNeed(need, group.Workflows)
+			if !ok {
+				cancelWorkflow(progress, "needed workflow "+need+" is not triggered by this commit")
+				cancelled = append(cancelled, progress)
+				break
+			}
+			progress.Needs = append(progress.Needs, resolvedNeed)
+		}
+	}
+	cancelled = append(cancelled, rejectDependencyCycles(group)...)
+	for _, progress := range cancelled {
+		createConfigMap(progress.ScmWorkflowDetails)
+	}
+
+	groupName := getDependencyGroup(workflowsDetails[0])
+	dependencyGroupsMutex.Lock()
+	dependencyGroups[groupName] = group
+	dependencyGroupsMutex.Unlock()
+	runDependencyGroup(groupName)
+}
+
+func handleNeedsJobState(job *batchv1.Job, state string) {
+	if !isJobFinished(state) {
+		return
+	}
+
+	groupName := job.Annotations["agnops/dependency-group"]
+	dependencyGroupsMutex.Lock()
+	group, ok := dependencyGroups[groupName]
+	if !ok {
+		dependencyGroupsMutex.Unlock()
+		return
+	}
+	progress, ok := group.Workflows[job.Annotations["agnops/workflow"]]
+	if !ok {
+		dependencyGroupsMutex.Unlock()
+		return
+	}
+	if state != JobSucceeded {
+		progress.Failed = true
+	} else {
+		progress.SucceededJobs[job.Name] = true
+	}
+	dependencyGroupsMutex.Unlock()
+
+	runDependencyGroup(groupName)
+}
+
+// Records the outcome of the jobs of a workflow from its runs. Reruns and skipped matrix cells are left out, as for
+// the jobs watch
+func applyWorkflowRunRecords(progress *workflowProgress, runRecords []*RunRecord) {
+	for _, runRecord := range runRecords {
+		if runRecord.Provider != progress.ScmWorkflowDetails.ScProvider || runRecord.RerunOf != "" {
+			continue
+		}
+		switch runRecord.Status {
+		case JobSucceeded:
+			progress.SucceededJobs[runRecord.JobName] = true
+		case JobFailed, JobCancelled:
+			progress.Failed = true
+		}
+	}
+}
+
+// Restores the groups saved before a restart. The jobs which finished in the meantime may have been deleted after
+// their TTL, so the outcome of the created workflows is read from their runs, the jobs watch then reports the ones
+// still running. The workflows which were starting when it stopped are started again, their job names being
+// deterministic
+func restoreDependencyGroups() {
+	secrets, err := secretsClient.List(context.TODO(), metav1.ListOptions{LabelSelector: "AgnOps=needs"})
+	if err != nil {
+		failOnError(err, "Failed to list the dependency groups")
+		return
+	}
+
+	restoredGroups := map[string]*dependencyGroup{}
+	var groupNames []string
+	for _, secret := range secrets.Items {
+		group := &dependencyGroup{}
+		if err := json.Unmarshal(secret.Data["Group"], group); err != nil {
+			log.Printf("Ignoring dependency group %s: %s\n", secret.Name, err)
+			continue
+		}
+		if group.CreatedAt.IsZero() {
+			group.CreatedAt = time.Now().UTC()
+		}
+		for _, progress := range group.Workflows {
+			if progress.Started && !progress.Generated && !progress.Failed {
+				progress.Started = false
+			}
+			if progress.SucceededJobs == nil {
+				progress.SucceededJobs = map[string]bool{}
+			}
+			if !progress.Generated || progress.Failed {
+				continue
+			}
+			details := progress.ScmWorkflowDetails
+			runRecords, err := listRunRecords(runRecordFilter{
+				Org:        details.GitOrgProject,
+				Repository: details.GitRepository,
+				CommitId:   details.CommitId,
+				Workflow:   details.Workflow.FileName,
+			})
+			if err != nil {
+				failOnError(err, "Failed to list the runs of workflow "+details.Workflow.FileName)
+				continue
+			}
+			applyWorkflowRunRecords(progress, runRecords)
+		}
+		groupName := secret.Annotations["agnops/dependency-group"]
+		restoredGroups[groupName] = group
+		groupNames = append(groupNames, groupName)
+	}
+
+	dependencyGroupsMutex.Lock()
+	for groupName, group := range restoredGroups {
+		dependencyGroups[groupName] = group
+	}
+	dependencyGroupsMutex.Unlock()
+
+	for _, groupName := range groupNames {
+		log.Printf("Restored the dependency group %s\n", groupName)
+		go runDependencyGroup(groupName)
+	}
+}
+
+// Cancels the workflows of the groups still waiting on their needs after NEEDS_TIMEOUT, such as the ones whose needed
+// jobs were deleted before their outcome was recorded, every minute
+func timeOutDependencyGroups() {
+	for {
+		time.Sleep(time.Minute)
+
+		var groupNames []string
+		var cancelled []*workflowProgress
+		oldest := time.Now().Add(-dependencyGroupTimeout)
+		dependencyGroupsMutex.Lock()
+		for groupName, group := range dependencyGroups {
+			if group.CreatedAt.After(oldest) {
+				continue
+			}
+			for _, name := range group.Order {
+				progress := group.Workflows[name]
+				if !progress.Started {
+					cancelWorkflow(progress, "timed out after "+dependencyGroupTimeout.String()+" waiting for its needs")
+					cancelled = append(cancelled, progress)
+				}
+			}
+			groupNames = append(groupNames, groupName)
+		}
+		dependencyGroupsMutex.Unlock()
+
+		for _, progress := range cancelled {
+			createConfigMap(progress.ScmWorkflowDetails)
+		}
+		for _, groupName := range groupNames {
+			runDependencyGroup(groupName)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import "testing"
+
+func TestApplyWorkflowRunRecords(t *testing.T) {
+	tests := []struct {
+		name          string
+		runRecords    []*RunRecord
+		wantSucceeded int
+		wantFailed    bool
+	}{
+		{
+			name:          "succeeded jobs",
+			runRecords:    []*RunRecord{{Provider: "github", JobName: "a", Status: JobSucceeded}, {Provider: "github", JobName: "b", Status: JobSucceeded}},
+			wantSucceeded: 2,
+		},
+		{
+			name:          "still running",
+			runRecords:    []*RunRecord{{Provider: "github", JobName: "a", Status: JobSucceeded}, {Provider: "github", JobName: "b", Status: JobRunning}},
+			wantSucceeded: 1,
+		},
+		{
+			name:       "cancelled job",
+			runRecords: []*RunRecord{{Provider: "github", JobName: "a", Status: JobCancelled}},
+			wantFailed: true,
+		},
+		{
+			name:       "rerun and other provider ignored",
+			runRecords: []*RunRecord{{Provider: "github", JobName: "c", Status: JobFailed, RerunOf: "a"}, {Provider: "gitlab", JobName: "a", Status: JobFailed}},
+		},
+		{
+			name:       "skipped matrix cell",
+			runRecords: []*RunRecord{{Provider: "github", JobName: "a", Status: JobSkipped}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			progress := &workflowProgress{ScmWorkflowDetails: &ScmWorkflowDetails{ScProvider: "github"}, SucceededJobs: map[string]bool{}}
+			applyWorkflowRunRecords(progress, test.runRecords)
+			if len(progress.SucceededJobs) != test.wantSucceeded || progress.Failed != test.wantFailed {
+				t.Fatalf("got %d succeeded jobs and failed %v, want %d and %v", len(progress.SucceededJobs), progress.Failed, test.wantSucceeded, test.wantFailed)
+			}
+		})
+	}
+}
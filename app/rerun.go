@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+)
+
+// Reported when the run exists but its state does not allow the rerun
+type rerunConflictError string
+
+func (err rerunConflictError) Error() string {
+	return string(err)
+}
+
+// Returns the attempt number following the latest attempt of the run's commit, workflow and matrix combination
+func getNextAttempt(runRecord *RunRecord) (int, error) {
+	runRecords, err := listRunRecords(runRecordFilter{Org: runRecord.Org, Repository: runRecord.Repository, CommitId: runRecord.CommitId, Workflow: runRecord.Workflow})
+	if err != nil {
+		return 0, err
+	}
+
+	attempt := runRecord.Attempt
+	for _, other := range runRecords {
+		if other.Provider == runRecord.Provider && other.Org == runRecord.Org && other.Repository == runRecord.Repository &&
+			other.CommitId == runRecord.CommitId && other.Workflow == runRecord.Workflow &&
+			getMatrixDescription(other.Matrix) == getMatrixDescription(runRecord.Matrix) && other.Attempt > attempt {
+			attempt = other.Attempt
+		}
+	}
+	return attempt + 1, nil
+}
+
+// Returns the containers which succeeded in the run, by their workflow name
+func getPassedSteps(runRecord *RunRecord, scmWorkflowDetails *ScmWorkflowDetails) map[string]bool {
+	succeeded := map[string]bool{}
+	for _, containerRun := range runRecord.Containers {
+		if containerRun.Status == JobSucceeded {
+			succeeded[containerRun.Name] = true
+		}
+	}
+
+	passedSteps := map[string]bool{}
+	for i, container := range scmWorkflowDetails.Workflow.WorkflowYaml.Workflow.Containers {
+		if succeeded[strconv.Itoa(i)+"-"+container.Name] {
+			passedSteps[container.Name] = true
+		}
+	}
+	return passedSteps
+}
+
+// Checks the stored workflow details against the current operator policies, as for a webhook, and resolves its
+// limits and placement again. The details were interpolated and their containers selected before being stored
+func checkRerunPolicies(scmWorkflowDetails *ScmWorkflowDetails) error {
+	kubernetes := scmWorkflowDetails.Workflow.WorkflowYaml.Workflow.Kubernetes
+	jobLimits, err := getJobLimits(kubernetes)
+	if err != nil {
+		return err
+	}
+	jobPlacement, err := getJobPlacement(kubernetes)
+	if err != nil {
+		return err
+	}
+	if err := checkWorkflowPolicies(scmWorkflowDetails); err != nil {
+		return err
+	}
+	scmWorkflowDetails.Workflow.JobLimits = jobLimits
+	scmWorkflowDetails.Workflow.JobPlacement = jobPlacement
+	return nil
+}
+
+// Creates a new attempt of a finished run from its stored workflow details. With failedOnly the steps which
+// succeeded are not run again, so it is refused unless the workflow declares caches, the persistent volume keeping
+// their outputs between attempts
+func rerunRun(runId string, failedOnly bool) (*RunRecord, error) {
+	runRecord, err := getRunRecord(runId)
+	if err != nil {
+		return nil, err
+	}
+	if !isJobFinished(runRecord.Status) {
+		return nil, rerunConflictError(fmt.Sprintf("run %s is %s, only finished runs can be rerun", runId, runRecord.Status))
+	}
+
+	scmWorkflowDetails, err := getRunDetails(runId)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkRerunPolicies(scmWorkflowDetails); err != nil {
+		return nil, rerunConflictError("run " + runId + " can not be rerun: " + err.Error())
+	}
+	scmWorkflowDetails.OAuthToken, err = GetUserOrOrganizationToken(scmWorkflowDetails.ScProvider, scmWorkflowDetails.GitOrgProject)
+	if err != nil {
+		return nil, err
+	}
+	scmWorkflowDetails.Attempt, err = getNextAttempt(runRecord)
+	if err != nil {
+		return nil, err
+	}
+
+	if failedOnly {
+		if runRecord.Status == JobSucceeded {
+			return nil, rerunConflictError("run " + runId + " has no failed steps")
+		}
+		if len(scmWorkflowDetails.Workflow.WorkflowYaml.Workflow.Caches) == 0 {
+			return nil, rerunConflictError("run " + runId + " can not rerun its failed steps only, its workflow declares no cache keeping the outputs of the steps which succeeded")
+		}
+		scmWorkflowDetails.Workflow.PassedSteps = getPassedSteps(runRecord, scmWorkflowDetails)
+	}
+
+	log.Printf("Rerunning run %s as attempt %d\n", runId, scmWorkflowDetails.Attempt)
+	if err := createJobObject(scmWorkflowDetails); err != nil {
+		return nil, err
+	}
+
+	rerunId := getJobName(scmWorkflowDetails)
+	err = updateRunRecord(rerunId, func(rerunRecord *RunRecord) {
+		rerunRecord.RerunOf = runId
+	})
+	if err != nil {
+		return nil, err
+	}
+	return getRunRecord(rerunId)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+)
+
+func writeJson(w http.ResponseWriter, statusCode int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(value)
+}
+
+func writeJsonError(w http.ResponseWriter, statusCode int, message string) {
+	writeJson(w, statusCode, map[string]string{"error": message})
+}
+
+// GET /api/runs, filtered by the org, repo, branch, commit, workflow and status query parameters
+func RunsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJsonError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	query := r.URL.Query()
+	runRecords, err := listRunRecords(runRecordFilter{
+		Org:        query.Get("org"),
+		Repository: query.Get("repo"),
+		Branch:     query.Get("branch"),
+		CommitId:   query.Get("commit"),
+		Workflow:   query.Get("workflow"),
+		Status:     query.Get("status"),
+	})
+	if err != nil {
+		writeJsonError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	limit, err := strconv.Atoi(query.Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = 100
+	}
+	if len(runRecords) > limit {
+		runRecords = runRecords[:limit]
+	}
+	if runRecords == nil {
+		runRecords = []*RunRecord{}
+	}
+	writeJson(w, http.StatusOK, runRecords)
+}
+
+var containerNameRegexp = regexp.MustCompile(`^[a-z0-9-]+$`)
+
+// Bearer token of the endpoints changing runs, such as reruns, usually set from a Secret. They are disabled without it
+var apiAdminToken = os.Getenv("API_ADMIN_TOKEN")
+
+// Writes the error and returns false when the request does not carry API_ADMIN_TOKEN
+func checkAdminToken(w http.ResponseWriter, r *http.Request) bool {
+	if apiAdminToken == "" {
+		writeJsonError(w, http.StatusForbidden, "this endpoint is disabled, API_ADMIN_TOKEN is not set")
+		return false
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(apiAdminToken)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeJsonError(w, http.StatusUnauthorized, "invalid or missing admin token")
+		return false
+	}
+	return true
+}
+
+// GET /api/runs/{id}, GET /api/runs/{id}/logs/{container}, {container}-retry-{n} for the pods retrying the job,
+// POST /api/runs/{id}/rerun, authenticated with API_ADMIN_TOKEN, which only reruns the failed steps with the
+// failedOnly=true query parameter, and GET or POST /api/runs/{id}/artifacts/{name}, downloads being authenticated by
+// checkArtifactsDownload and limited to the runs of the repository of the requesting run
+func RunHandler(w http.ResponseWriter, r *http.Request) {
+	pathParts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/runs/"), "/"), "/")
+	runId := pathParts[0]
+
+	switch {
+	case len(pathParts) == 1 && r.Method == http.MethodGet:
+		runRecord, err := getRunRecord(runId)
+		if errors.IsNotFound(err) {
+			writeJsonError(w, http.StatusNotFound, "run "+runId+" not found")
+			return
+		}
+		if err != nil {
+			writeJsonError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if runRecord.Status == JobQueued {
+			runRecord.QueuePosition, err = getQueuePosition(runId)
+			failOnError(err, "Failed to read the queue position of run "+runId)
+		}
+		writeJson(w, http.StatusOK, runRecord)
+
+	case len(pathParts) == 3 && pathParts[1] == "logs" && r.Method == http.MethodGet:
+		if !containerNameRegexp.MatchString(runId) || !containerNameRegexp.MatchString(pathParts[2]) {
+			writeJsonError(w, http.StatusBadRequest, "invalid run or container name")
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if err := readContainerLogs(runId, pathParts[2], w); err != nil {
+			if os.IsNotExist(err) {
+				writeJsonError(w, http.StatusNotFound, "no logs for container "+pathParts[2]+" of run "+runId)
+				return
+			}
+			failOnError(err, "Failed to read the logs of run "+runId)
+		}
+
+	case len(pathParts) == 2 && pathParts[1] == "rerun" && r.Method == http.MethodPost:
+		if !checkAdminToken(w, r) {
+			return
+		}
+		runRecord, err := rerunRun(runId, r.URL.Query().Get("failedOnly") == "true")
+		if errors.IsNotFound(err) {
+			writeJsonError(w, http.StatusNotFound, "run "+runId+" not found")
+			return
+		}
+		if _, ok := err.(rerunConflictError); ok {
+			writeJsonError(w, http.StatusConflict, err.Error())
+			return
+		}
+		if err != nil {
+			writeJsonError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJson(w, http.StatusCreated, runRecord)
+
+	case len(pathParts) == 3 && pathParts[1] == "artifacts":
+		if !containerNameRegexp.MatchString(runId) || !artifactNameRegexp.MatchString(pathParts[2]) {
+			writeJsonError(w, http.StatusBadRequest, "invalid run or artifact name")
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			requestingRun, ok := checkArtifactsDownload(w, r)
+			if !ok {
+				return
+			}
+			if requestingRun != nil && requestingRun.Id != runId {
+				runRecord, err := getRunRecord(runId)
+				if errors.IsNotFound(err) {
+					writeJsonError(w, http.StatusNotFound, "run "+runId+" not found")
+					return
+				}
+				if err != nil {
+					writeJsonError(w, http.StatusInternalServerError, err.Error())
+					return
+				}
+				if !strings.EqualFold(runRecord.Org, requestingRun.Org) || !strings.EqualFold(runRecord.Repository, requestingRun.Repository) {
+					writeJsonError(w, http.StatusForbidden, "run "+runId+" is not a run of the repository of run "+requestingRun.Id)
+					return
+				}
+			}
+			writeArtifact(w, runId, pathParts[2])
+		case http.MethodPost:
+			uploadArtifact(w, r, runId, pathParts[2])
+		default:
+			writeJsonError(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+
+	default:
+		writeJsonError(w, http.StatusNotFound, "not found")
+	}
+}
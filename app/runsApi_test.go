@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestRerunRequiresAdminToken(t *testing.T) {
+	previousToken := apiAdminToken
+	defer func() { apiAdminToken = previousToken }()
+
+	tests := []struct {
+		name          string
+		adminToken    string
+		authorization string
+		want          int
+	}{
+		{name: "disabled", adminToken: "", authorization: "Bearer anything", want: http.StatusForbidden},
+		{name: "missing token", adminToken: "s3cr3t", want: http.StatusUnauthorized},
+		{name: "wrong token", adminToken: "s3cr3t", authorization: "Bearer guess", want: http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			apiAdminToken = test.adminToken
+			request := httptest.NewRequest(http.MethodPost, "/api/runs/run-1/rerun", nil)
+			if test.authorization != "" {
+				request.Header.Set("Authorization", test.authorization)
+			}
+			recorder := httptest.NewRecorder()
+			RunHandler(recorder, request)
+			if recorder.Code != test.want {
+				t.Errorf("got status %d, want %d", recorder.Code, test.want)
+			}
+		})
+	}
+}
+
+func TestArtifactDownloadsAreScopedToTheRepository(t *testing.T) {
+	previousConfigMapClient, previousToken, previousKey := configMapClient, apiAdminToken, artifactsKey
+	defer func() {
+		configMapClient, apiAdminToken, artifactsKey = previousConfigMapClient, previousToken, previousKey
+	}()
+	configMapClient = fake.NewSimpleClientset().CoreV1().ConfigMaps(namespace)
+	apiAdminToken = ""
+	artifactsKeyOnce.Do(func() {})
+	artifactsKey = []byte("test-key")
+
+	for _, runRecord := range []*RunRecord{
+		{Id: "run-a", Org: "agnops", Repository: "job-generator", CommitId: "1", Workflow: "build.yaml"},
+		{Id: "run-b", Org: "agnops", Repository: "examples", CommitId: "1", Workflow: "build.yaml"},
+	} {
+		if err := createRunRecord(runRecord, &ScmWorkflowDetails{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name          string
+		url           string
+		authorization string
+		handler       http.HandlerFunc
+		want          int
+	}{
+		{name: "no token", url: "/api/runs/run-b/artifacts/dist", handler: RunHandler, want: http.StatusForbidden},
+		{name: "wrong run token", url: "/api/runs/run-b/artifacts/dist?run=run-a", authorization: "Bearer " + getArtifactsToken("run-b"), handler: RunHandler, want: http.StatusUnauthorized},
+		{name: "other repository", url: "/api/runs/run-b/artifacts/dist?run=run-a", authorization: "Bearer " + getArtifactsToken("run-a"), handler: RunHandler, want: http.StatusForbidden},
+		{name: "commit artifacts without token", url: "/api/artifacts?org=agnops&repo=examples&commit=1&workflow=build&name=dist", handler: ArtifactsHandler, want: http.StatusForbidden},
+		{name: "commit artifacts of the run", url: "/api/artifacts?run=run-a&workflow=build&name=dist", authorization: "Bearer " + getArtifactsToken("run-a"), handler: ArtifactsHandler, want: http.StatusNotFound},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, test.url, nil)
+			if test.authorization != "" {
+				request.Header.Set("Authorization", test.authorization)
+			}
+			recorder := httptest.NewRecorder()
+			test.handler(recorder, request)
+			if recorder.Code != test.want {
+				t.Errorf("got status %d, want %d: %s", recorder.Code, test.want, recorder.Body.String())
+			}
+		})
+	}
+}
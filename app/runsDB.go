@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var runRetentionDays = getEnvInt("RUN_HISTORY_RETENTION_DAYS", 30)
+
+// Run history of a generated job, persisted in a ConfigMap labeled AgnOps: run. Like the tokens and workflow errors,
+// runs are kept in the cluster rather than in an embedded database, so the generator needs no volume and any of its
+// replicas reads the same history. The labels of the ConfigMap index the fields the runs are listed by
+type RunRecord struct {
+	Id         string            `json:"id"`
+	Provider   string            `json:"provider"`
+	Org        string            `json:"org"`
+	Repository string            `json:"repository"`
+	Branch     string            `json:"branch"`
+	Tag        string            `json:"tag,omitempty"`
+	CommitId   string            `json:"commitId"`
+	CommitUrl  string            `json:"commitUrl"`
+	Workflow   string            `json:"workflow"`
+	Matrix     map[string]string `json:"matrix,omitempty"`
+	Attempt    int               `json:"attempt"`
+	Event      string            `json:"event"`
+	Status     string            `json:"status"`
+	JobName    string            `json:"jobName"`
+	CreatedAt  time.Time         `json:"createdAt"`
+	StartedAt  *time.Time        `json:"startedAt,omitempty"`
+	FinishedAt *time.Time        `json:"finishedAt,omitempty"`
+	Reason     string            `json:"reason,omitempty"`
+	RerunOf    string            `json:"rerunOf,omitempty"`
+	Containers []ContainerRun    `json:"containers,omitempty"`
+	Artifacts  []ArtifactRecord  `json:"artifacts,omitempty"`
+	// Set once the artifacts were deleted by the retention policy
+	ArtifactsExpired bool `json:"artifactsExpired,omitempty"`
+
+	// Position in the job queue, only set by the runs API while the run is queued
+	QueuePosition int `json:"queuePosition,omitempty"`
+}
+
+func getRunConfigMapName(runId string) string {
+	return "agnops-run-" + runId
+}
+
+// Fields of runRecordFilter compared with the run labels, which are lower case
+func getRunLabelValue(value string) string {
+	return getLabelValue(strings.ToLower(value))
+}
+
+func getRunRecordLabels(runRecord *RunRecord) map[string]string {
+	return map[string]string{
+		"AgnOps":            "run",
+		"agnops/org":        getRunLabelValue(runRecord.Org),
+		"agnops/repository": getRunLabelValue(runRecord.Repository),
+		"agnops/branch":     getRunLabelValue(runRecord.Branch),
+		"agnops/commit":     getRunLabelValue(runRecord.CommitId),
+		"agnops/workflow":   getRunLabelValue(runRecord.Workflow),
+		"agnops/status":     getRunLabelValue(runRecord.Status),
+	}
+}
+
+// Selects the runs listed by listRunRecords, empty fields match every run. Labels only hold 63 characters of the
+// fields, the records are compared with the filter once read
+type runRecordFilter struct {
+	Org        string
+	Repository string
+	Branch     string
+	CommitId   string
+	Workflow   string
+	Status     string
+}
+
+func (filter runRecordFilter) getLabelSelector() string {
+	selector := "AgnOps=run"
+	for label, value := range map[string]string{
+		"agnops/org":        filter.Org,
+		"agnops/repository": filter.Repository,
+		"agnops/branch":     filter.Branch,
+		"agnops/commit":     filter.CommitId,
+		"agnops/workflow":   filter.Workflow,
+		"agnops/status":     filter.Status,
+	} {
+		if value != "" {
+			selector += "," + label + "=" + getRunLabelValue(value)
+		}
+	}
+	return selector
+}
+
+func matchRunFilter(filter string, value string) bool {
+	return filter == "" || strings.EqualFold(filter, value)
+}
+
+func (filter runRecordFilter) match(runRecord *RunRecord) bool {
+	return matchRunFilter(filter.Org, runRecord.Org) &&
+		matchRunFilter(filter.Repository, runRecord.Repository) &&
+		matchRunFilter(filter.Branch, runRecord.Branch) &&
+		matchRunFilter(filter.CommitId, runRecord.CommitId) &&
+		matchRunFilter(filter.Workflow, runRecord.Workflow) &&
+		matchRunFilter(filter.Status, runRecord.Status)
+}
+
+func newRunRecord(scmWorkflowDetails *ScmWorkflowDetails, jobName string) *RunRecord {
+	return &RunRecord{
+		Id:         jobName,
+		Provider:   scmWorkflowDetails.ScProvider,
+		Org:        scmWorkflowDetails.GitOrgProject,
+		Repository: scmWorkflowDetails.GitRepository,
+		Branch:     scmWorkflowDetails.Branch,
+		Tag:        scmWorkflowDetails.Tag,
+		CommitId:   scmWorkflowDetails.CommitId,
+		CommitUrl:  scmWorkflowDetails.CommitUrl,
+		Workflow:   scmWorkflowDetails.Workflow.FileName,
+		Matrix:     scmWorkflowDetails.Matrix,
+		Attempt:    getRunAttempt(scmWorkflowDetails),
+		Event:      scmWorkflowDetails.Event,
+		Status:     JobPending,
+		JobName:    jobName,
+		CreatedAt:  time.Now().UTC(),
+	}
+}
+
+// Creates the run record, next to the workflow details it was created from so it can be rerun. The OAuth token is
+// left out of them
+func createRunRecord(runRecord *RunRecord, scmWorkflowDetails *ScmWorkflowDetails) error {
+	content, err := json.Marshal(runRecord)
+	if err != nil {
+		return err
+	}
+	storedDetails := *scmWorkflowDetails
+	storedDetails.OAuthToken = ""
+	detailsContent, err := json.Marshal(storedDetails)
+	if err != nil {
+		return err
+	}
+
+	configMapSpec := apiv1.ConfigMap{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "ConfigMap",
+			APIVersion: "v1",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      getRunConfigMapName(runRecord.Id),
+			Namespace: namespace,
+			Labels:    getRunRecordLabels(runRecord),
+		},
+		Data: map[string]string{
+			"Run":     string(content),
+			"Details": string(detailsContent),
+		},
+	}
+
+	_, err = configMapClient.Create(context.TODO(), &configMapSpec, metav1.CreateOptions{})
+	return err
+}
+
+// Records a workflow whose containers were all skipped as a finished run, and reports it as a commit status
+func recordSkippedRun(scmWorkflowDetails *ScmWorkflowDetails) {
+	runRecord := newRunRecord(scmWorkflowDetails, getJobName(scmWorkflowDetails))
+	runRecord.Status = JobSkipped
+	runRecord.FinishedAt = &runRecord.CreatedAt
+	runRecord.Reason = "every container was skipped: " + strings.Join(scmWorkflowDetails.Workflow.SkippedContainers, "; ")
+
+	err := createRunRecord(runRecord, scmWorkflowDetails)
+	if errors.IsAlreadyExists(err) {
+		return
+	}
+	failOnError(err, "Failed to record the skipped run "+runRecord.Id)
+	queueSkippedCommitStatus(scmWorkflowDetails, runRecord.Id)
+}
+
+func getRunRecord(runId string) (*RunRecord, error) {
+	configMap, err := configMapClient.Get(context.TODO(), getRunConfigMapName(runId), metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	runRecord := &RunRecord{}
+	err = json.Unmarshal([]byte(configMap.Data["Run"]), runRecord)
+	return runRecord, err
+}
+
+// Returns the workflow details a run was created from, without the OAuth token
+func getRunDetails(runId string) (*ScmWorkflowDetails, error) {
+	configMap, err := configMapClient.Get(context.TODO(), getRunConfigMapName(runId), metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	if configMap.Data["Details"] == "" {
+		return nil, fmt.Errorf("run %s has no stored workflow details", runId)
+	}
+	scmWorkflowDetails := &ScmWorkflowDetails{}
+	err = json.Unmarshal([]byte(configMap.Data["Details"]), scmWorkflowDetails)
+	return scmWorkflowDetails, err
+}
+
+// Reads, modifies and writes back a run record
+func updateRunRecord(runId string, update func(runRecord *RunRecord)) error {
+	configMap, err := configMapClient.Get(context.TODO(), getRunConfigMapName(runId), metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	runRecord := &RunRecord{}
+	if err := json.Unmarshal([]byte(configMap.Data["Run"]), runRecord); err != nil {
+		return err
+	}
+
+	update(runRecord)
+
+	content, err := json.Marshal(runRecord)
+	if err != nil {
+		return err
+	}
+	configMap.Data["Run"] = string(content)
+	configMap.Labels = getRunRecordLabels(runRecord)
+	_, err = configMapClient.Update(context.TODO(), configMap, metav1.UpdateOptions{})
+	return err
+}
+
+// Returns the run records matching filter, most recent first. The API server only returns the ConfigMaps whose
+// labels match it
+func listRunRecords(filter runRecordFilter) ([]*RunRecord, error) {
+	configMaps, err := configMapClient.List(context.TODO(), metav1.ListOptions{LabelSelector: filter.getLabelSelector()})
+	if err != nil {
+		return nil, err
+	}
+
+	var runRecords []*RunRecord
+	for _, configMap := range configMaps.Items {
+		runRecord := &RunRecord{}
+		if err := json.Unmarshal([]byte(configMap.Data["Run"]), runRecord); err != nil {
+			log.Printf("Ignoring run %s: %s\n", configMap.Name, err)
+			continue
+		}
+		if filter.match(runRecord) {
+			runRecords = append(runRecords, runRecord)
+		}
+	}
+	sort.Slice(runRecords, func(i, j int) bool {
+		return runRecords[i].CreatedAt.After(runRecords[j].CreatedAt)
+	})
+	return runRecords, nil
+}
+
+func recordJobState(job *batchv1.Job, state string) {
+	containerRuns := getJobContainerRuns(job)
+	err := updateRunRecord(job.Name, func(runRecord *RunRecord) {
+		// A cancelled job is deleted, the watch may still deliver its earlier states
+		if runRecord.Status == JobCancelled {
+			return
+		}
+		now := time.Now().UTC()
+		runRecord.Status = state
+		if state == JobRunning && runRecord.StartedAt == nil {
+			runRecord.StartedAt = &now
+		}
+		if isJobFinished(state) {
+			runRecord.FinishedAt = &now
+		}
+		if len(containerRuns) > 0 {
+			runRecord.Containers = containerRuns
+		}
+	})
+	if err != nil {
+		log.Printf("Failed to record the %s state of job %s: %s\n", state, job.Name, err)
+	}
+}
+
+// Deletes the runs older than RUN_HISTORY_RETENTION_DAYS with their logs and artifacts, and the artifacts older than
+// ARTIFACT_RETENTION_DAYS, every hour
+func pruneRunRecords() {
+	for {
+		runRecords, err := listRunRecords(runRecordFilter{})
+		failOnError(err, "Failed to list the runs")
+
+		oldest := time.Now().AddDate(0, 0, -runRetentionDays)
+		var keptRunRecords []*RunRecord
+		for _, runRecord := range runRecords {
+			if runRecord.CreatedAt.Before(oldest) {
+				err := configMapClient.Delete(context.TODO(), getRunConfigMapName(runRecord.Id), metav1.DeleteOptions{})
+				failOnError(err, "Failed to delete the run "+runRecord.Id)
+				err = logStore.Delete(runRecord.Id)
+				failOnError(err, "Failed to delete the logs of run "+runRecord.Id)
+				err = artifactStore.Delete(runRecord.Id)
+				failOnError(err, "Failed to delete the artifacts of run "+runRecord.Id)
+				continue
+			}
+			keptRunRecords = append(keptRunRecords, runRecord)
+		}
+		pruneRunArtifacts(keptRunRecords)
+		time.Sleep(time.Hour)
+	}
+}
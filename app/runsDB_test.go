@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestListRunRecords(t *testing.T) {
+	previousConfigMapClient := configMapClient
+	defer func() { configMapClient = previousConfigMapClient }()
+	configMapClient = fake.NewSimpleClientset().CoreV1().ConfigMaps(namespace)
+
+	runs := []*RunRecord{
+		{Id: "a", Org: "AgnOps", Repository: "job-generator", Branch: "feature/runs", CommitId: "1", Workflow: "build.yaml", Status: JobSucceeded},
+		{Id: "b", Org: "agnops", Repository: "job-generator", Branch: "master", CommitId: "2", Workflow: "build.yaml", Status: JobFailed},
+		{Id: "c", Org: "agnops", Repository: "examples", Branch: "master", CommitId: "3", Workflow: "test.yaml", Status: JobSucceeded},
+		// Shares the branch label of run a
+		{Id: "d", Org: "agnops", Repository: "job-generator", Branch: "feature-runs", CommitId: "4", Workflow: "build.yaml", Status: JobRunning},
+	}
+	for i, runRecord := range runs {
+		runRecord.CreatedAt = time.Date(2020, 7, 1, i, 0, 0, 0, time.UTC)
+		if err := createRunRecord(runRecord, &ScmWorkflowDetails{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := updateRunRecord("d", func(runRecord *RunRecord) { runRecord.Status = JobFailed }); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		filter runRecordFilter
+		want   []string
+	}{
+		{name: "every run, most recent first", want: []string{"d", "c", "b", "a"}},
+		{name: "org in any case", filter: runRecordFilter{Org: "AGNOPS", Repository: "job-generator"}, want: []string{"d", "b", "a"}},
+		{name: "branch sharing a label", filter: runRecordFilter{Branch: "feature/runs"}, want: []string{"a"}},
+		{name: "updated status", filter: runRecordFilter{Status: JobFailed}, want: []string{"d", "b"}},
+		{name: "commit and workflow", filter: runRecordFilter{CommitId: "3", Workflow: "test.yaml"}, want: []string{"c"}},
+		{name: "no match", filter: runRecordFilter{Repository: "unknown"}, want: nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			runRecords, err := listRunRecords(test.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var ids []string
+			for _, runRecord := range runRecords {
+				ids = append(ids, runRecord.Id)
+			}
+			if len(ids) != len(test.want) {
+				t.Fatalf("got runs %v, want %v", ids, test.want)
+			}
+			for i := range ids {
+				if ids[i] != test.want[i] {
+					t.Fatalf("got runs %v, want %v", ids, test.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	apiv1 "k8s.io/api/core/v1"
+)
+
+// Installation defaults hardening the job pods. Steps and helpers run as JOB_RUN_AS_USER with no capability and no
+// privilege escalation, and the pods get no service account token. JOB_READ_ONLY_ROOT_FILESYSTEM=true also makes
+// their root filesystem read only, with a writable /tmp. Services keep the user of their image, see
+// getServiceSecurityContext
+var jobRunAsNonRoot = os.Getenv("JOB_RUN_AS_NON_ROOT") != "false"
+var jobRunAsUser = int64(getEnvInt("JOB_RUN_AS_USER", 1000))
+var jobRunAsGroup = int64(getEnvInt("JOB_RUN_AS_GROUP", 1000))
+var jobFsGroup = int64(getEnvInt("JOB_FS_GROUP", 1000))
+var jobReadOnlyRootFilesystem = os.Getenv("JOB_READ_ONLY_ROOT_FILESYSTEM") == "true"
+var jobDropCapabilities = os.Getenv("JOB_DROP_CAPABILITIES") != "false"
+
+// Opt-outs of kubernetes.security a workflow may use, among runAsRoot, writableRootFilesystem,
+// allowPrivilegeEscalation and capabilities, and the capabilities it may add. privileged allows the privileged
+// sidecar of the dind builder
+var securityExceptionAllowlist = getEnvList("JOB_SECURITY_EXCEPTION_ALLOWLIST")
+var capabilityAllowlist = getEnvList("JOB_CAPABILITY_ALLOWLIST")
+
+// Service accounts a workflow may run as, to deploy to the cluster for instance, as org/repo=name entries, or
+// org=name for every repository of an org. Their token is the only one mounted
+var serviceAccountAllowlist = getEnvList("JOB_SERVICE_ACCOUNT_ALLOWLIST")
+
+const (
+	SecurityExceptionRunAsRoot                = "runAsRoot"
+	SecurityExceptionWritableRootFilesystem   = "writableRootFilesystem"
+	SecurityExceptionAllowPrivilegeEscalation = "allowPrivilegeEscalation"
+	SecurityExceptionCapabilities             = "capabilities"
+	SecurityExceptionPrivileged               = "privileged"
+)
+
+// Opt-outs of the hardened defaults for every container of the workflow, each one allowed by
+// JOB_SECURITY_EXCEPTION_ALLOWLIST
+type WorkflowSecurity struct {
+	RunAsRoot                bool     `yaml:"runAsRoot"`
+	WritableRootFilesystem   bool     `yaml:"writableRootFilesystem"`
+	AllowPrivilegeEscalation bool     `yaml:"allowPrivilegeEscalation"`
+	Capabilities             []string `yaml:"capabilities"`
+}
+
+// The kaniko and host Docker socket builders run as root and write to the root filesystem. They need no security
+// exception, the host Docker socket being allowed by ALLOW_HOST_DOCKER_SOCKET
+func getStepSecurity(security WorkflowSecurity, builder string) WorkflowSecurity {
+	if builder == BuilderKaniko || builder == BuilderDockerSocket {
+		security.RunAsRoot = true
+		security.WritableRootFilesystem = true
+	}
+	return security
+}
+
+func checkSecurityException(exception string, reason string) error {
+	if !containsString(securityExceptionAllowlist, exception) {
+		return fmt.Errorf("%s needs the %s security exception, which is not allowed", reason, exception)
+	}
+	return nil
+}
+
+func checkWorkflowSecurity(security WorkflowSecurity, reason string) error {
+	if security.RunAsRoot && jobRunAsNonRoot {
+		if err := checkSecurityException(SecurityExceptionRunAsRoot, reason); err != nil {
+			return err
+		}
+	}
+	if security.WritableRootFilesystem && jobReadOnlyRootFilesystem {
+		if err := checkSecurityException(SecurityExceptionWritableRootFilesystem, reason); err != nil {
+			return err
+		}
+	}
+	if security.AllowPrivilegeEscalation && jobDropCapabilities {
+		if err := checkSecurityException(SecurityExceptionAllowPrivilegeEscalation, reason); err != nil {
+			return err
+		}
+	}
+	if len(security.Capabilities) > 0 {
+		if err := checkSecurityException(SecurityExceptionCapabilities, reason); err != nil {
+			return err
+		}
+		for _, capability := range security.Capabilities {
+			if !containsString(capabilityAllowlist, capability) {
+				return fmt.Errorf("%s: capability %s is not allowed", reason, capability)
+			}
+		}
+	}
+	return nil
+}
+
+func checkSecurity(scmWorkflowDetails *ScmWorkflowDetails) error {
+	kubernetes := scmWorkflowDetails.Workflow.WorkflowYaml.Workflow.Kubernetes
+	if err := checkWorkflowSecurity(kubernetes.Security, "workflow.kubernetes.security"); err != nil {
+		return err
+	}
+	for _, container := range scmWorkflowDetails.Workflow.WorkflowYaml.Workflow.Containers {
+		if builder := getContainerBuilder(container); builder == BuilderDind {
+			if err := checkSecurityException(SecurityExceptionPrivileged, fmt.Sprintf("container %q: the privileged %s builder", container.Name, builder)); err != nil {
+				return err
+			}
+		}
+	}
+	if kubernetes.ServiceAccountName != "" && !isServiceAccountAllowed(kubernetes.ServiceAccountName, scmWorkflowDetails) {
+		return fmt.Errorf("workflow.kubernetes.serviceAccountName: service account %s is not allowed for %s/%s", kubernetes.ServiceAccountName, scmWorkflowDetails.GitOrgProject, scmWorkflowDetails.GitRepository)
+	}
+	return nil
+}
+
+// Unlike the other allowlists, a service account entry always names the repositories allowed to use it
+func isServiceAccountAllowed(name string, scmWorkflowDetails *ScmWorkflowDetails) bool {
+	for _, entry := range serviceAccountAllowlist {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) == 2 && isWorkflowRepository(parts[0], scmWorkflowDetails) && strings.TrimSpace(parts[1]) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// The user is set by container, so services keep the one of their image. fsGroup lets every container write to the
+// shared volumes
+func getPodSecurityContext() *apiv1.PodSecurityContext {
+	return &apiv1.PodSecurityContext{FSGroup: &jobFsGroup}
+}
+
+func getContainerSecurityContext(security WorkflowSecurity) *apiv1.SecurityContext {
+	securityContext := &apiv1.SecurityContext{}
+	if security.RunAsRoot {
+		runAsNonRoot := false
+		rootUser := int64(0)
+		securityContext.RunAsNonRoot = &runAsNonRoot
+		securityContext.RunAsUser = &rootUser
+		securityContext.RunAsGroup = &rootUser
+	} else if jobRunAsNonRoot {
+		runAsNonRoot := true
+		securityContext.RunAsNonRoot = &runAsNonRoot
+		securityContext.RunAsUser = &jobRunAsUser
+		securityContext.RunAsGroup = &jobRunAsGroup
+	}
+	readOnlyRootFilesystem := jobReadOnlyRootFilesystem && !security.WritableRootFilesystem
+	securityContext.ReadOnlyRootFilesystem = &readOnlyRootFilesystem
+
+	if jobDropCapabilities {
+		allowPrivilegeEscalation := security.AllowPrivilegeEscalation
+		securityContext.AllowPrivilegeEscalation = &allowPrivilegeEscalation
+		securityContext.Capabilities = &apiv1.Capabilities{Drop: []apiv1.Capability{"ALL"}}
+	}
+	if len(security.Capabilities) > 0 {
+		if securityContext.Capabilities == nil {
+			securityContext.Capabilities = &apiv1.Capabilities{}
+		}
+		for _, capability := range security.Capabilities {
+			securityContext.Capabilities.Add = append(securityContext.Capabilities.Add, apiv1.Capability(capability))
+		}
+	}
+	return securityContext
+}
+
+// Services keep the user, root filesystem and capabilities of their image, database images for instance starting as
+// root to prepare their data directory before switching to their own user. They only lose privilege escalation
+func getServiceSecurityContext() *apiv1.SecurityContext {
+	securityContext := &apiv1.SecurityContext{}
+	if jobDropCapabilities {
+		allowPrivilegeEscalation := false
+		securityContext.AllowPrivilegeEscalation = &allowPrivilegeEscalation
+	}
+	return securityContext
+}
+
+// Hardens the containers without a security context, the builder sidecars setting their own, and mounts the tmp
+// volume at /tmp of those with a read only root filesystem. Returns whether the tmp volume is used
+func setContainerSecurityContexts(containers []apiv1.Container, security WorkflowSecurity) bool {
+	usesTmpVolume := false
+	for i := range containers {
+		if containers[i].SecurityContext == nil {
+			containers[i].SecurityContext = getContainerSecurityContext(security)
+		}
+		readOnlyRootFilesystem := containers[i].SecurityContext.ReadOnlyRootFilesystem
+		if readOnlyRootFilesystem != nil && *readOnlyRootFilesystem {
+			containers[i].VolumeMounts = append(containers[i].VolumeMounts, apiv1.VolumeMount{MountPath: "/tmp", Name: "tmp"})
+			usesTmpVolume = true
+		}
+	}
+	return usesTmpVolume
+}
+
+// Service account token of the job pods, only mounted for the allowed service account named by the workflow
+func getServiceAccount(workflowKubernetes WorkflowKubernetes) (string, *bool) {
+	automountServiceAccountToken := workflowKubernetes.ServiceAccountName != ""
+	return workflowKubernetes.ServiceAccountName, &automountServiceAccountToken
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckSecurity(t *testing.T) {
+	previousExceptions, previousServiceAccounts := securityExceptionAllowlist, serviceAccountAllowlist
+	defer func() {
+		securityExceptionAllowlist, serviceAccountAllowlist = previousExceptions, previousServiceAccounts
+	}()
+	serviceAccountAllowlist = []string{"deployer", "agnops/job-generator=job-generator-deployer", "agnops=org-reader"}
+
+	tests := []struct {
+		name           string
+		repository     string
+		exceptions     []string
+		builder        string
+		runAsRoot      bool
+		serviceAccount string
+		wantErr        string
+	}{
+		{name: "buildkit", repository: "job-generator", builder: BuilderBuildKit},
+		{name: "kaniko running as root", repository: "job-generator", builder: BuilderKaniko},
+		{name: "host Docker socket running as root", repository: "job-generator", builder: BuilderDockerSocket},
+		{name: "root workflow without the exception", repository: "job-generator", runAsRoot: true, wantErr: "runAsRoot security exception"},
+		{name: "root workflow with the exception", repository: "job-generator", exceptions: []string{SecurityExceptionRunAsRoot}, runAsRoot: true},
+		{name: "dind without the exception", repository: "job-generator", builder: BuilderDind, wantErr: "privileged security exception"},
+		{name: "dind with the exception", repository: "job-generator", exceptions: []string{SecurityExceptionPrivileged}, builder: BuilderDind},
+		{name: "service account of the repository", repository: "job-generator", serviceAccount: "job-generator-deployer"},
+		{name: "service account of the org", repository: "examples", serviceAccount: "org-reader"},
+		{name: "service account of another repository", repository: "examples", serviceAccount: "job-generator-deployer", wantErr: "not allowed for AgnOps/examples"},
+		{name: "unscoped service account", repository: "job-generator", serviceAccount: "deployer", wantErr: "not allowed"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			securityExceptionAllowlist = test.exceptions
+			details := &ScmWorkflowDetails{GitOrgProject: "AgnOps", GitRepository: test.repository}
+			container := WorkflowContainer{Name: "build"}
+			container.AddOns.Builder = test.builder
+			details.Workflow.WorkflowYaml.Workflow.Containers = []WorkflowContainer{container}
+			details.Workflow.WorkflowYaml.Workflow.Kubernetes.ServiceAccountName = test.serviceAccount
+			details.Workflow.WorkflowYaml.Workflow.Kubernetes.Security.RunAsRoot = test.runAsRoot
+			err := checkSecurity(details)
+			if test.wantErr == "" && err != nil {
+				t.Fatalf("unexpected error %s", err)
+			}
+			if test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)) {
+				t.Fatalf("got error %v, want %q", err, test.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+
+	apiv1 "k8s.io/api/core/v1"
+)
+
+var serviceNameRegexp = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,40}[a-z0-9])?$`)
+
+// A container running next to the steps, reachable on localhost. Command replaces the image entrypoint and starts the
+// service, which is stopped by the sidecar entrypoint once the steps finished. Without it the image entrypoint runs,
+// and is sent SIGTERM once the steps finished, see sidecarHookScript. Ready is a shell command succeeding once it
+// accepts connections, the steps waiting for it
+type WorkflowService struct {
+	Name       string            `yaml:"name"`
+	Image      string            `yaml:"image"`
+	PullPolicy string            `yaml:"pullPolicy"`
+	Command    string            `yaml:"command"`
+	Ready      string            `yaml:"ready"`
+	Env        map[string]string `yaml:"env"`
+	Resources  struct {
+		Limits struct {
+			CPU    string `yaml:"cpu"`
+			Memory string `yaml:"memory"`
+		} `yaml:"limits"`
+		Requests struct {
+			CPU    string `yaml:"cpu"`
+			Memory string `yaml:"memory"`
+		} `yaml:"requests"`
+	} `yaml:"resources"`
+}
+
+func getServiceSidecarName(service WorkflowService) string {
+	return "service-" + service.Name
+}
+
+func checkServices(services []WorkflowService) error {
+	names := map[string]bool{}
+	for i, service := range services {
+		if !serviceNameRegexp.MatchString(service.Name) {
+			return fmt.Errorf("workflow.services[%d]: name %q must be a lowercase DNS label of at most 42 characters", i, service.Name)
+		}
+		if names[service.Name] {
+			return fmt.Errorf("workflow.services[%d]: duplicate service name %q", i, service.Name)
+		}
+		names[service.Name] = true
+		if service.Image == "" || service.Ready == "" {
+			return fmt.Errorf("workflow.services[%d]: service %q needs an image and a ready command", i, service.Name)
+		}
+	}
+	return nil
+}
+
+func getServiceSidecars(services []WorkflowService, stepsCount int, cachedImages bool, untrustedEnvs []apiv1.EnvVar) []apiv1.Container {
+	var sidecars []apiv1.Container
+	for _, service := range services {
+		env := append([]apiv1.EnvVar{}, untrustedEnvs...)
+		for _, key := range getSortedKeys(service.Env) {
+			env = append(env, apiv1.EnvVar{Name: key, Value: service.Env[key]})
+		}
+		sidecar := getSidecarContainer(getServiceSidecarName(service), service.Image, service.Command, service.Ready, stepsCount, env)
+		sidecar.SecurityContext = getServiceSecurityContext()
+		sidecar.ImagePullPolicy = getWorkflowImagePullPolicy(service.Image, service.PullPolicy, cachedImages)
+		sidecar.Resources = apiv1.ResourceRequirements{
+			Limits:   getResourceList(service.Resources.Limits.CPU, service.Resources.Limits.Memory),
+			Requests: getResourceList(service.Resources.Requests.CPU, service.Resources.Requests.Memory),
+		}
+		sidecars = append(sidecars, sidecar)
+	}
+	return sidecars
+}
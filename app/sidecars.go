@@ -0,0 +1,101 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	apiv1 "k8s.io/api/core/v1"
+)
+
+// Entrypoint of the sidecar containers. It starts AGNOPS_SIDECAR_COMMAND, writes ok to its ready file once
+// AGNOPS_SIDECAR_READY succeeds and stops it when every step of AGNOPS_SIDECAR_STEPS recorded its exit code, so the
+// pod completes. The ready file holds failed when the command exits before being ready
+const sidecarScript = `
+steps=` + stepsDir + `
+mkdir -p $steps
+chmod 777 $steps 2>/dev/null
+` + stepWaitFunctions + `
+heartbeat $AGNOPS_SIDECAR_NAME &
+
+sh -c "$AGNOPS_SIDECAR_COMMAND" &
+pid=$!
+until sh -c "$AGNOPS_SIDECAR_READY" >/dev/null 2>&1; do
+  if ! kill -0 $pid 2>/dev/null; then
+    echo "agnops: $AGNOPS_SIDECAR_NAME exited before being ready"
+    echo failed > $steps/$AGNOPS_SIDECAR_NAME.ready
+    exit 1
+  fi
+  sleep 1
+done
+echo "agnops: $AGNOPS_SIDECAR_NAME is ready"
+echo ok > $steps/$AGNOPS_SIDECAR_NAME.ready
+
+for step in $AGNOPS_SIDECAR_STEPS; do
+  wait_for $step exit
+done
+echo "agnops: stopping $AGNOPS_SIDECAR_NAME, the steps finished"
+kill $pid 2>/dev/null
+wait $pid
+exit 0
+`
+
+// PostStart hook of the sidecars without a command, which run the entrypoint of their image. It reports the sidecar
+// ready and stops it like sidecarScript, from the background as the kubelet waits for the hook to return. The
+// entrypoint, PID 1 of the container, is sent SIGTERM, and must exit with 0 for the pod to succeed, as database images
+// do. Its output goes to the container logs
+const sidecarHookScript = `
+monitor() {
+  steps=` + stepsDir + `
+  mkdir -p $steps
+  chmod 777 $steps 2>/dev/null
+` + stepWaitFunctions + `
+  heartbeat $AGNOPS_SIDECAR_NAME &
+  until sh -c "$AGNOPS_SIDECAR_READY" >/dev/null 2>&1; do
+    sleep 1
+  done
+  echo "agnops: $AGNOPS_SIDECAR_NAME is ready"
+  echo ok > $steps/$AGNOPS_SIDECAR_NAME.ready
+
+  for step in $AGNOPS_SIDECAR_STEPS; do
+    wait_for $step exit
+  done
+  echo "agnops: stopping $AGNOPS_SIDECAR_NAME, the steps finished"
+  kill -TERM 1
+}
+
+out=/dev/null
+[ -w /proc/1/fd/1 ] && out=/proc/1/fd/1
+monitor </dev/null >$out 2>&1 &
+`
+
+// Returns a container running command next to the steps until they all finished, or the image entrypoint when
+// command is empty. Steps wait for it through AGNOPS_STEP_WAIT_FOR, its readiness probe reports the same ready file
+func getSidecarContainer(name string, image string, command string, readyCommand string, stepsCount int, env []apiv1.EnvVar) apiv1.Container {
+	var steps []string
+	for i := 0; i < stepsCount; i++ {
+		steps = append(steps, strconv.Itoa(i))
+	}
+
+	sidecarEnv := []apiv1.EnvVar{
+		{Name: "AGNOPS_SIDECAR_NAME", Value: name},
+		{Name: "AGNOPS_SIDECAR_COMMAND", Value: command},
+		{Name: "AGNOPS_SIDECAR_READY", Value: readyCommand},
+		{Name: "AGNOPS_SIDECAR_STEPS", Value: strings.Join(steps, " ")},
+	}
+	sidecar := apiv1.Container{
+		Name:         name,
+		Image:        image,
+		Command:      []string{"sh", "-c", sidecarScript},
+		Env:          append(sidecarEnv, env...),
+		VolumeMounts: []apiv1.VolumeMount{{MountPath: "/data", Name: "containers-data"}},
+		ReadinessProbe: &apiv1.Probe{
+			Handler:       apiv1.Handler{Exec: &apiv1.ExecAction{Command: []string{"grep", "-q", "ok", stepsDir + "/" + name + ".ready"}}},
+			PeriodSeconds: 2,
+		},
+	}
+	if command == "" {
+		sidecar.Command = nil
+		sidecar.Lifecycle = &apiv1.Lifecycle{PostStart: &apiv1.Handler{Exec: &apiv1.ExecAction{Command: []string{"sh", "-c", sidecarHookScript}}}}
+	}
+	return sidecar
+}
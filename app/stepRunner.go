@@ -0,0 +1,308 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	apiv1 "k8s.io/api/core/v1"
+)
+
+const stepsDir = "/data/.agnops/steps"
+
+var maxStepRetries = getEnvInt("STEP_MAX_RETRIES", 5)
+
+// Termination message of the containers skipped because a step they need did not succeed
+const skippedStepMessage = "skipped"
+
+// Termination message of the steps which succeeded in the attempt a failed steps rerun comes from
+const passedStepMessage = "passed"
+
+// Shell functions shared by the step runner and the sidecars. Steps and sidecars touch their alive file while they
+// run, so a container killed before recording its outcome, by the OOM killer for instance, is detected once its alive
+// file is a minute old. wait_for then records the outcome as killed, which is neither 0 nor ok. Containers which
+// never start are failed by watchJobPods
+const stepWaitFunctions = `
+heartbeat() {
+  while :; do touch $steps/$1.alive; sleep 10; done
+}
+
+wait_for() {
+  while [ ! -f $steps/$1.$2 ]; do
+    if [ -n "$(find $steps -maxdepth 1 -name $1.alive -mmin +1 2>/dev/null)" ]; then
+      echo "agnops: $1 stopped without recording its outcome"
+      echo killed > $steps/$1.$2.$$ && mv -f $steps/$1.$2.$$ $steps/$1.$2
+    fi
+    sleep 1
+  done
+}
+`
+
+// Entrypoint of every workflow container. A step with AGNOPS_STEP_PASSED succeeded in the attempt being rerun and
+// succeeds right away. Other steps wait for the sidecars of AGNOPS_STEP_WAIT_FOR to be ready, then for the exit code
+// of the steps listed in AGNOPS_STEP_NEEDS, so independent steps run in parallel. The step is skipped when one of
+// them did not succeed, otherwise it links the paths of AGNOPS_STEP_CACHES to the working directories of the caches,
+// failing when a path can not be linked, and runs AGNOPS_STEP_SCRIPT, killed after AGNOPS_STEP_TIMEOUT seconds and
+// retried AGNOPS_STEP_RETRIES times on the exit codes of AGNOPS_STEP_RETRY_ON, then records its exit code. The
+// outcome is also the termination message of the container. The script runs in its own session when setsid is
+// available, so a timeout or the termination of the container kills every process it started, and the outcome is
+// still recorded
+const stepRunnerScript = `
+steps=` + stepsDir + `
+mkdir -p $steps
+chmod 777 $steps 2>/dev/null
+` + stepWaitFunctions + `
+finish() {
+  echo "$1" > $steps/$AGNOPS_STEP_INDEX.tmp && mv $steps/$AGNOPS_STEP_INDEX.tmp $steps/$AGNOPS_STEP_INDEX.exit
+  echo "$3" > /dev/termination-log 2>/dev/null
+  exit $2
+}
+
+# Processes are killed by process group, the script's pid, when the script is a session leader
+group=
+command -v setsid >/dev/null 2>&1 && group=-
+pid=
+attempt=0
+terminate() {
+  [ -n "$pid" ] && kill -TERM $group$pid 2>/dev/null
+  echo "agnops: step $AGNOPS_STEP_NAME was terminated"
+  finish 143 143 "exit=143 attempts=$attempt"
+}
+trap terminate TERM INT
+heartbeat $AGNOPS_STEP_INDEX &
+
+# The job user has no home directory in most images, the steps then share one on the data volume
+if [ ! -w "${HOME:-/}" ]; then
+  export HOME=/data/.agnops/home
+  mkdir -p $HOME
+fi
+
+if [ "$AGNOPS_STEP_PASSED" = "true" ]; then
+  echo "agnops: step $AGNOPS_STEP_NAME succeeded in the previous attempt"
+  finish 0 0 ` + passedStepMessage + `
+fi
+
+for sidecar in $AGNOPS_STEP_WAIT_FOR; do
+  wait_for $sidecar ready
+  if [ "$(cat $steps/$sidecar.ready)" != "ok" ]; then
+    echo "agnops: step $AGNOPS_STEP_NAME failed, $sidecar did not start"
+    finish 1 1 "exit=1 attempts=0"
+  fi
+done
+
+for need in $AGNOPS_STEP_NEEDS; do
+  wait_for $need exit
+  if [ "$(cat $steps/$need.exit)" != "0" ]; then
+    echo "agnops: skipping step $AGNOPS_STEP_NAME, step $need did not succeed"
+    finish skipped 1 ` + skippedStepMessage + `
+  fi
+done
+
+run_attempt() {
+  rm -f $steps/$AGNOPS_STEP_INDEX.timeout
+  if [ -n "$group" ]; then
+    setsid sh -c "$AGNOPS_STEP_SCRIPT" &
+  else
+    sh -c "$AGNOPS_STEP_SCRIPT" &
+  fi
+  pid=$!
+  watchdog=
+  if [ -n "$AGNOPS_STEP_TIMEOUT" ]; then
+    (sleep $AGNOPS_STEP_TIMEOUT; touch $steps/$AGNOPS_STEP_INDEX.timeout; kill -TERM $group$pid; sleep 10; kill -KILL $group$pid) 2>/dev/null &
+    watchdog=$!
+  fi
+  wait $pid
+  code=$?
+  [ -n "$watchdog" ] && kill $watchdog 2>/dev/null
+  pid=
+  if [ -f $steps/$AGNOPS_STEP_INDEX.timeout ]; then
+    echo "agnops: step $AGNOPS_STEP_NAME timed out after ${AGNOPS_STEP_TIMEOUT}s"
+    code=124
+  fi
+}
+
+for cache in $AGNOPS_STEP_CACHES; do
+  name=${cache%%:*}
+  rest=${cache#*:}
+  path=${rest#*:}
+  dir=$(cat ` + cacheWorkDirsDir + `/$name)/${rest%%:*}
+  [ -L "$path" ] && rm -f "$path"
+  rmdir "$path" 2>/dev/null
+  if [ -e "$path" ]; then
+    echo "agnops: not caching $path, it is not empty in the image"
+  elif ! mkdir -p "$dir" "$(dirname "$path")" || ! ln -s "$dir" "$path"; then
+    echo "agnops: step $AGNOPS_STEP_NAME failed, can not link $path to cache $name, its parent directory must be writable"
+    finish 1 1 "exit=1 attempts=0"
+  fi
+done
+
+cd /data/repo
+attempt=1
+delay=${AGNOPS_STEP_RETRY_BACKOFF:-0}
+while :; do
+  run_attempt
+  [ $code -eq 0 ] && break
+  [ $attempt -gt ${AGNOPS_STEP_RETRIES:-0} ] && break
+  if [ -n "$AGNOPS_STEP_RETRY_ON" ]; then
+    case " $AGNOPS_STEP_RETRY_ON " in *" $code "*) ;; *) break ;; esac
+  fi
+  echo "agnops: step $AGNOPS_STEP_NAME failed with exit code $code on attempt $attempt, retrying in ${delay}s"
+  sleep $delay
+  delay=$((delay * 2))
+  attempt=$((attempt + 1))
+done
+echo "agnops: step $AGNOPS_STEP_NAME finished with exit code $code on attempt $attempt"
+finish $code $code "exit=$code attempts=$attempt"
+`
+
+// Returns the names of the containers each container depends on. Without dependsOn a container depends on the
+// previous one, an empty dependsOn starts it right away
+func getContainersDependencies(containers []WorkflowContainer) (map[string][]string, error) {
+	dependencies := map[string][]string{}
+	for i, container := range containers {
+		if _, ok := dependencies[container.Name]; ok {
+			return nil, fmt.Errorf("duplicate container name %q", container.Name)
+		}
+		switch {
+		case container.DependsOn != nil:
+			dependencies[container.Name] = container.DependsOn
+		case i > 0:
+			dependencies[container.Name] = []string{containers[i-1].Name}
+		default:
+			dependencies[container.Name] = []string{}
+		}
+	}
+
+	for _, container := range containers {
+		for _, dependency := range dependencies[container.Name] {
+			if _, ok := dependencies[dependency]; !ok {
+				return nil, fmt.Errorf("container %q depends on unknown container %q", container.Name, dependency)
+			}
+		}
+	}
+
+	const (
+		visiting = iota + 1
+		visited
+	)
+	states := map[string]int{}
+	var visit func(name string) error
+	visit = func(name string) error {
+		switch states[name] {
+		case visiting:
+			return fmt.Errorf("dependsOn cycle through container %q", name)
+		case visited:
+			return nil
+		}
+		states[name] = visiting
+		for _, dependency := range dependencies[name] {
+			if err := visit(dependency); err != nil {
+				return err
+			}
+		}
+		states[name] = visited
+		return nil
+	}
+	for _, container := range containers {
+		if err := visit(container.Name); err != nil {
+			return nil, err
+		}
+	}
+	return dependencies, nil
+}
+
+// Maps the dependencies of the running containers to step indexes. A dependency on a skipped container is
+// replaced by the dependencies of that container, so the order between the remaining steps is kept
+func getStepNeeds(containers []WorkflowContainer, dependencies map[string][]string, skipped map[string]bool) [][]int {
+	stepIndexes := map[string]int{}
+	for i, container := range containers {
+		stepIndexes[container.Name] = i
+	}
+
+	var resolve func(name string, needs map[int]bool)
+	resolve = func(name string, needs map[int]bool) {
+		for _, dependency := range dependencies[name] {
+			if skipped[dependency] {
+				resolve(dependency, needs)
+			} else {
+				needs[stepIndexes[dependency]] = true
+			}
+		}
+	}
+
+	stepNeeds := make([][]int, len(containers))
+	for i, container := range containers {
+		needs := map[int]bool{}
+		resolve(container.Name, needs)
+		for need := range needs {
+			stepNeeds[i] = append(stepNeeds[i], need)
+		}
+		sort.Ints(stepNeeds[i])
+	}
+	return stepNeeds
+}
+
+// Checks the timeout and retry policy of a container
+func checkStepPolicy(container WorkflowContainer) error {
+	if container.Timeout != "" {
+		timeout, err := time.ParseDuration(container.Timeout)
+		if err != nil || timeout < time.Second {
+			return fmt.Errorf("container %q: timeout must be a duration of at least 1s", container.Name)
+		}
+	}
+	if container.Retry.Count < 0 || container.Retry.Count > maxStepRetries {
+		return fmt.Errorf("container %q: retry.count must be between 0 and %d", container.Name, maxStepRetries)
+	}
+	if container.Retry.Backoff != "" {
+		// The step runner sleeps whole seconds
+		if backoff, err := time.ParseDuration(container.Retry.Backoff); err != nil || backoff < 0 || (backoff > 0 && backoff < time.Second) {
+			return fmt.Errorf("container %q: retry.backoff must be 0s or a duration of at least 1s", container.Name)
+		}
+	}
+	return nil
+}
+
+// Parses the attempts count out of the termination message written by the step runner
+func getStepAttempts(terminationMessage string) int {
+	for _, field := range strings.Fields(terminationMessage) {
+		if strings.HasPrefix(field, "attempts=") {
+			attempts, _ := strconv.Atoi(strings.TrimPrefix(field, "attempts="))
+			return attempts
+		}
+	}
+	return 0
+}
+
+func getStepEnvs(stepIndex int, stepName string, needs []int, container WorkflowContainer) []apiv1.EnvVar {
+	var stepNeeds []string
+	for _, need := range needs {
+		stepNeeds = append(stepNeeds, strconv.Itoa(need))
+	}
+
+	envs := []apiv1.EnvVar{
+		{Name: "AGNOPS_STEP_INDEX", Value: strconv.Itoa(stepIndex)},
+		{Name: "AGNOPS_STEP_NAME", Value: stepName},
+		{Name: "AGNOPS_STEP_NEEDS", Value: strings.Join(stepNeeds, " ")},
+		{Name: "AGNOPS_STEP_SCRIPT", Value: container.Command},
+	}
+
+	// The policy was checked by checkStepPolicy
+	if timeout, err := time.ParseDuration(container.Timeout); err == nil {
+		envs = append(envs, apiv1.EnvVar{Name: "AGNOPS_STEP_TIMEOUT", Value: strconv.Itoa(int(timeout.Seconds()))})
+	}
+	if container.Retry.Count > 0 {
+		var retryOn []string
+		for _, exitCode := range container.Retry.OnExitCodes {
+			retryOn = append(retryOn, strconv.Itoa(exitCode))
+		}
+		backoff, _ := time.ParseDuration(container.Retry.Backoff)
+		envs = append(envs,
+			apiv1.EnvVar{Name: "AGNOPS_STEP_RETRIES", Value: strconv.Itoa(container.Retry.Count)},
+			apiv1.EnvVar{Name: "AGNOPS_STEP_RETRY_BACKOFF", Value: strconv.Itoa(int(backoff.Seconds()))},
+			apiv1.EnvVar{Name: "AGNOPS_STEP_RETRY_ON", Value: strings.Join(retryOn, " ")},
+		)
+	}
+	return envs
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestGetContainersDependencies(t *testing.T) {
+	container := func(name string, dependsOn ...string) WorkflowContainer {
+		return WorkflowContainer{Name: name, DependsOn: dependsOn}
+	}
+
+	tests := []struct {
+		name       string
+		containers []WorkflowContainer
+		want       map[string][]string
+		wantErr    string
+	}{
+		{
+			name:       "sequential by default",
+			containers: []WorkflowContainer{{Name: "build"}, {Name: "test"}, {Name: "deploy"}},
+			want:       map[string][]string{"build": {}, "test": {"build"}, "deploy": {"test"}},
+		},
+		{
+			name:       "explicit dependencies",
+			containers: []WorkflowContainer{{Name: "build"}, {Name: "lint", DependsOn: []string{}}, container("test", "build"), container("deploy", "lint", "test")},
+			want:       map[string][]string{"build": {}, "lint": {}, "test": {"build"}, "deploy": {"lint", "test"}},
+		},
+		{
+			name:       "duplicate name",
+			containers: []WorkflowContainer{{Name: "build"}, {Name: "build"}},
+			wantErr:    "duplicate container name",
+		},
+		{
+			name:       "unknown dependency",
+			containers: []WorkflowContainer{container("test", "build")},
+			wantErr:    "unknown container",
+		},
+		{
+			name:       "self dependency",
+			containers: []WorkflowContainer{container("build", "build")},
+			wantErr:    "cycle",
+		},
+		{
+			name:       "cycle",
+			containers: []WorkflowContainer{container("a", "c"), container("b", "a"), container("c", "b")},
+			wantErr:    "cycle",
+		},
+		{
+			name:       "cycle behind an implicit dependency",
+			containers: []WorkflowContainer{container("a", "b"), {Name: "b"}},
+			wantErr:    "cycle",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dependencies, err := getContainersDependencies(test.containers)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("expected an error containing %q, got %v", test.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !reflect.DeepEqual(dependencies, test.want) {
+				t.Errorf("got %v, want %v", dependencies, test.want)
+			}
+		})
+	}
+}
+
+func TestCheckStepPolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		timeout string
+		backoff string
+		wantErr bool
+	}{
+		{name: "no policy"},
+		{name: "timeout and backoff", timeout: "10m", backoff: "30s"},
+		{name: "no backoff", backoff: "0s"},
+		{name: "sub-second timeout", timeout: "500ms", wantErr: true},
+		{name: "sub-second backoff", backoff: "500ms", wantErr: true},
+		{name: "negative backoff", backoff: "-1s", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			container := WorkflowContainer{Name: "build", Timeout: test.timeout}
+			container.Retry.Count = 1
+			container.Retry.Backoff = test.backoff
+			if err := checkStepPolicy(container); (err != nil) != test.wantErr {
+				t.Fatalf("got error %v, want an error: %v", err, test.wantErr)
+			}
+		})
+	}
+}